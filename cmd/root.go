@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"log/slog"
 	"os"
 	"path/filepath"
@@ -8,6 +9,7 @@ import (
 	charmlog "github.com/charmbracelet/log"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
+	"github.com/yixuan-wang/tyw/pkg/util"
 	"golang.org/x/term"
 )
 
@@ -44,8 +46,26 @@ func init() {
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "Config file (default: $XDG_CONFIG_HOME/tyw.toml)")
 	rootCmd.PersistentFlags().CountVarP(&Verbose, "verbose", "v", "Verbosity level, max at `-vvv` (default: 0)")
 	rootCmd.PersistentFlags().BoolVarP(&Debug, "debug", "D", false, "Print debug information")
+	rootCmd.PersistentFlags().Var(pickerValue{}, "picker", "Interactive picker: auto, fzf or builtin")
 }
 
+// The `--picker` flag, validated when set.
+type pickerValue struct{}
+
+func (pickerValue) String() string { return util.Picker }
+
+func (pickerValue) Set(name string) error {
+	picker, ok := util.ParsePicker(name)
+	if !ok {
+		// Wrapped by pflag with the flag and the value
+		return errors.New("expected auto, fzf or builtin")
+	}
+	util.Picker = picker
+	return nil
+}
+
+func (pickerValue) Type() string { return "string" }
+
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
 	if cfgFile != "" {
@@ -1,52 +1,115 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/signal"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/yixuan-wang/tyw/pkg/tg"
 	"github.com/yixuan-wang/tyw/pkg/util"
+	"golang.org/x/term"
 )
 
+// The chat name given by `--to`
+var tgTo string
+
 var tgCmd = &cobra.Command{
 	Use:   "tg",
 	Short: "Telegram utilities.",
 	Long: `Utilities for sending quick messages through Telegram.`,
 	PersistentPreRunE: func(cmd *cobra.Command, args []string) error {
-		return tg.InitConfig()
+		if err := tg.InitConfig(); err != nil {
+			return err
+		}
+		tg.RecoverDigests()
+		return nil
+	},
+	// Messages queued by earlier failures are sent once Telegram is reachable again
+	PersistentPostRun: func(cmd *cobra.Command, args []string) {
+		if !tg.OutboxPending() {
+			return
+		}
+		ctx, cancel := context.WithTimeout(cmd.Context(), 30*time.Second)
+		defer cancel()
+		if sent, left, err := tg.FlushOutbox(ctx, false); err != nil {
+			slog.Warn("Cannot flush outbox", "error", err)
+		} else {
+			slog.Info("Flushed outbox", "sent", sent, "left", left)
+		}
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(tgCmd)
 
-	tgCmd.AddCommand(&cobra.Command{
-		Use:   "text",
+	tgCmd.PersistentFlags().StringVar(&tgTo, "to", "", "Name of the chat in [tg.chats] (default: default_chat)")
+
+	tgTextCmd := cobra.Command{
+		Use:   "text [message...]",
 		Short: "Text to a chat",
-		Long:  `Send a text message to a Telegram chat.`,
+		Long: `Send a text message to a Telegram chat. The message is read from stdin if it is not given or is "-".
+
+With --template, the message is rendered from a template in [tg.templates] instead, where the message given, if any, is available as {{.message}}.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
+			templateName, _ := cmd.Flags().GetString("template")
+			varFlags, _ := cmd.Flags().GetStringArray("var")
+
 			var message string
-			if len(args) == 0 {
-				message = "Hello, world!"
+			var err error
+			if templateName != "" {
+				message, err = renderTemplate(templateName, varFlags, args)
 			} else {
-				message = args[0]
+				message, err = readMessage(args)
+			}
+			if err != nil {
+				return err
+			}
+
+			parseModeFlag, _ := cmd.Flags().GetString("parse-mode")
+			parseMode, ok := tg.ParseParseMode(parseModeFlag)
+			if !ok {
+				return util.Fail("Invalid --parse-mode, expected markdownv2 or html", "parse-mode", parseModeFlag)
 			}
+			code, _ := cmd.Flags().GetBool("code")
 
-			chatId, err := tg.GetChatId()
+			chat, err := tg.GetChat(tgTo)
 			if err != nil {
 				return err
 			}
-			tg.SendMessage(chatId, message)
-			return nil
+			readSendOptionFlags(cmd, &chat.Options)
+
+			_, err = tg.SendText(chat, message, tg.TextOptions{ParseMode: parseMode, Code: code, Queue: true})
+			if errors.Is(err, tg.ErrQueued) {
+				fmt.Fprintf(os.Stderr, "Cannot send now, queued in outbox: %s\n", err)
+				return nil
+			}
+			return err
 		},
-	})
+	}
+	tgTextCmd.Flags().StringP("parse-mode", "p", "", "Parse mode of the message: markdownv2 or html")
+	tgTextCmd.Flags().Bool("code", false, "Wrap the message in a code block")
+	tgTextCmd.Flags().StringP("template", "T", "", "Render the message from a template in [tg.templates]")
+	tgTextCmd.Flags().StringArray("var", nil, "Variable of the template as key=value, can be repeated")
+	addSendOptionFlags(&tgTextCmd)
+
+	tgCmd.AddCommand(&tgTextCmd)
 
 	tgPingCmd := cobra.Command{
 		Use: "ping",
 		Short: "Send a ping message",
 		Long: `Send a ping message to a Telegram chat.`,
 		RunE: func(cmd *cobra.Command, args []string) error {
-			chatId, err := tg.GetChatId()
+			chat, err := tg.GetChat(tgTo)
 			if err != nil {
 				return err
 			}
@@ -58,7 +121,17 @@ func init() {
 
 			timeout, _ := cmd.Flags().GetDuration("timeout")
 
-			if err := tg.SendPing(chatId, text, true, timeout); err != nil {
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			err = tg.SendPing(ctx, chat, text, true, timeout)
+			switch {
+			case errors.Is(err, tg.ErrTimeout):
+				fmt.Fprintf(os.Stderr, "Timeout after %s\n", timeout)
+				os.Exit(1)
+			case errors.Is(err, context.Canceled):
+				os.Exit(130)
+			case err != nil:
 				return util.Fail("Didn't receive a response.")
 			}
 			return nil
@@ -67,4 +140,467 @@ func init() {
 	tgPingCmd.Flags().DurationP("timeout", "t", 6 * time.Hour, "Duration to wait before timeout")
 
 	tgCmd.AddCommand(&tgPingCmd)
+
+	tgRunCmd := cobra.Command{
+		Use:   "run [flags] -- <command>...",
+		Short: "Run a command and notify when it finishes",
+		Long:  `Run a command, then send a message with its exit status, wall time and the last lines of its output. Exits with the status of the command.`,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			on, _ := cmd.Flags().GetString("on")
+			switch on {
+			case tg.NotifyAlways, tg.NotifySuccess, tg.NotifyFailure:
+			default:
+				return util.Fail("Invalid --on, expected always, success or failure", "on", on)
+			}
+			lines, _ := cmd.Flags().GetInt("lines")
+
+			chat, err := tg.GetChat(tgTo)
+			if err != nil {
+				return err
+			}
+
+			result := tg.RunCommand(args, lines)
+			if result.ShouldNotify(on) {
+				if _, err := tg.SendText(chat, result.Message(), tg.TextOptions{Queue: true}); err != nil {
+					slog.Error("Cannot notify command result", "error", err)
+				}
+			}
+
+			if result.ExitCode != 0 {
+				os.Exit(result.ExitCode)
+			}
+			return nil
+		},
+	}
+	tgRunCmd.Flags().String("on", tg.NotifyAlways, "When to notify: always, success or failure")
+	tgRunCmd.Flags().IntP("lines", "n", 10, "Number of output lines to include")
+	// Flags after the command belong to it
+	tgRunCmd.Flags().SetInterspersed(false)
+
+	tgCmd.AddCommand(&tgRunCmd)
+
+	tgFileCmd := cobra.Command{
+		Use:   "file <path>...",
+		Short: "Send files to a chat",
+		Long:  `Send files to a Telegram chat. Images are sent as photos, other files as documents, and several files as albums.`,
+		Args:  cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			chat, err := tg.GetChat(tgTo)
+			if err != nil {
+				return err
+			}
+
+			caption, _ := cmd.Flags().GetString("caption")
+			return tg.SendFiles(chat, args, caption)
+		},
+	}
+	tgFileCmd.Flags().StringP("caption", "c", "", "Caption of the files")
+
+	tgCmd.AddCommand(&tgFileCmd)
+
+	tgSetupCmd := cobra.Command{
+		Use:   "setup",
+		Short: "Set up the bot token and chat",
+		Long:  `Validate the bot token, wait for a message to the bot, pick the chat it comes from, and save both to the config file. With --to, the chat is saved under that name in [tg.chats].`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			token, _ := cmd.Flags().GetString("token")
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			return tg.Setup(token, tgTo, timeout)
+		},
+	}
+	tgSetupCmd.Flags().String("token", "", "Bot token (default: the token in config)")
+	tgSetupCmd.Flags().DurationP("timeout", "t", 5*time.Minute, "Duration to wait for a message to the bot")
+
+	tgCmd.AddCommand(&tgSetupCmd)
+
+	tgAskCmd := cobra.Command{
+		Use:   "ask <question>",
+		Short: "Ask a question with choices",
+		Long:  `Send a question with a button for each choice, and wait for one to be pressed. The choice is printed, and the exit code is its index, or 124 on timeout. With --text, wait for a reply to the question instead and print its text.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			choices, _ := cmd.Flags().GetStringArray("choice")
+			if len(choices) == 0 {
+				choices = []string{"Yes", "No"}
+			}
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+			text, _ := cmd.Flags().GetBool("text")
+			cleanup, _ := cmd.Flags().GetBool("delete")
+
+			if text && cmd.Flags().Changed("choice") {
+				return util.Fail("--text cannot be used with --choice")
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			chat, err := tg.GetChat(tgTo)
+			if err != nil {
+				return err
+			}
+
+			if text {
+				reply, err := tg.AskText(ctx, chat, args[0], cleanup, timeout)
+				if errors.Is(err, tg.ErrTimeout) {
+					fmt.Fprintf(os.Stderr, "Timeout after %s\n", timeout)
+					os.Exit(124)
+				} else if errors.Is(err, context.Canceled) {
+					os.Exit(130)
+				} else if err != nil {
+					return err
+				}
+
+				fmt.Println(reply)
+				return nil
+			}
+
+			chosen, err := tg.Ask(ctx, chat, args[0], choices, timeout)
+			if errors.Is(err, tg.ErrTimeout) {
+				fmt.Fprintf(os.Stderr, "Timeout after %s\n", timeout)
+				os.Exit(124)
+			} else if errors.Is(err, context.Canceled) {
+				os.Exit(130)
+			} else if err != nil {
+				return err
+			}
+
+			fmt.Println(choices[chosen])
+			os.Exit(chosen)
+			return nil
+		},
+	}
+	tgAskCmd.Flags().StringArrayP("choice", "c", nil, "A choice, in the order of exit codes from 0 (default: Yes and No)")
+	tgAskCmd.Flags().DurationP("timeout", "t", 6*time.Hour, "Duration to wait before timeout")
+	tgAskCmd.Flags().Bool("text", false, "Wait for a free-text reply instead of a choice")
+	tgAskCmd.Flags().Bool("delete", false, "Delete the question and the reply afterwards, with --text")
+
+	tgCmd.AddCommand(&tgAskCmd)
+
+	tgProgressCmd := cobra.Command{
+		Use:   "progress [title]",
+		Short: "Show progress in one message",
+		Long:  `Send one message, then keep editing it to show the latest line read from stdin. With --bar, lines like "n/total" are shown with a progress bar.`,
+		Args:  cobra.MaximumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var opts tg.ProgressOptions
+			if len(args) > 0 {
+				opts.Title = args[0]
+			}
+			opts.Interval, _ = cmd.Flags().GetDuration("interval")
+			opts.Bar, _ = cmd.Flags().GetBool("bar")
+
+			chat, err := tg.GetChat(tgTo)
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			err = tg.Progress(ctx, chat, os.Stdin, opts)
+			if errors.Is(err, context.Canceled) {
+				os.Exit(130)
+			}
+			return err
+		},
+	}
+	tgProgressCmd.Flags().DurationP("interval", "i", 3*time.Second, "Minimum interval between edits")
+	tgProgressCmd.Flags().BoolP("bar", "b", false, "Show a progress bar for lines like n/total")
+
+	tgCmd.AddCommand(&tgProgressCmd)
+
+	tgDaemonCmd := cobra.Command{
+		Use:   "daemon",
+		Short: "Own the update stream of a bot",
+		Long:  `Run as the single consumer of updates of a bot, serving them to waiting commands such as ping and ask over a Unix socket. Without a daemon, each command polls updates itself.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			bot, _ := cmd.Flags().GetString("bot")
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return tg.RunDaemon(ctx, tg.NewClient(bot))
+		},
+	}
+	tgDaemonCmd.Flags().String("bot", "", "Name of the bot in [tg.bots] (default: the default bot)")
+
+	tgCmd.AddCommand(&tgDaemonCmd)
+
+	tgServeCmd := cobra.Command{
+		Use:   "serve",
+		Short: "Run whitelisted commands from a chat",
+		Long:  `Listen to the chat, and run the commands in [tg.commands] when users in allowed_users send them, replying with their output.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			chat, err := tg.GetChat(tgTo)
+			if err != nil {
+				return err
+			}
+
+			opts := tg.GetServeOptions()
+			opts.Timeout, _ = cmd.Flags().GetDuration("timeout")
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return tg.Serve(ctx, chat, opts)
+		},
+	}
+	tgServeCmd.Flags().DurationP("timeout", "t", time.Minute, "Duration a command may run before it is killed")
+
+	tgCmd.AddCommand(&tgServeCmd)
+
+	tgFlushCmd := cobra.Command{
+		Use:   "flush",
+		Short: "Send messages queued in the outbox",
+		Long:  `Send the messages queued in the outbox after failing to be sent, regardless of when they are due for retry.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			sent, left, err := tg.FlushOutbox(ctx, true)
+			if err != nil {
+				return err
+			}
+			fmt.Printf("Sent %d, %d left in outbox\n", sent, left)
+			if left > 0 {
+				os.Exit(1)
+			}
+			return nil
+		},
+		// Flushed already
+		PersistentPostRun: func(cmd *cobra.Command, args []string) {},
+	}
+
+	tgCmd.AddCommand(&tgFlushCmd)
+
+	tgWatchCmd := cobra.Command{
+		Use:   "watch <file>",
+		Short: "Alert on lines matching a pattern in a file",
+		Long:  `Follow a file like tail -F, including its rotation, and send the lines matching --match with lines around them. Matches in a burst are sent in one message.`,
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			match, _ := cmd.Flags().GetString("match")
+			pattern, err := regexp.Compile(match)
+			if err != nil {
+				return util.Fail("Invalid --match", "match", match, "error", err)
+			}
+
+			opts := tg.WatchOptions{Pattern: pattern}
+			opts.Context, _ = cmd.Flags().GetInt("context")
+			opts.Debounce, _ = cmd.Flags().GetDuration("debounce")
+			opts.Once, _ = cmd.Flags().GetBool("once")
+
+			chat, err := tg.GetChat(tgTo)
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			return tg.Watch(ctx, chat, args[0], opts)
+		},
+	}
+	tgWatchCmd.Flags().StringP("match", "m", "", "Regular expression to match lines")
+	tgWatchCmd.Flags().IntP("context", "C", 3, "Number of lines before and after a match to include")
+	tgWatchCmd.Flags().Duration("debounce", 10*time.Second, "Duration to collect matches before sending them")
+	tgWatchCmd.Flags().Bool("once", false, "Exit after the first message")
+	tgWatchCmd.MarkFlagRequired("match")
+
+	tgCmd.AddCommand(&tgWatchCmd)
+
+	tgWaitCmd := cobra.Command{
+		Use:   "wait",
+		Short: "Wait for a running process to exit and notify",
+		Long:  `Wait for a process already running, given by --pid or found by --name like pgrep -f, then send a message with its command line, run time, and exit status if it can be read. If several processes match the name, one is picked interactively.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			pid, _ := cmd.Flags().GetInt("pid")
+			name, _ := cmd.Flags().GetString("name")
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			if name != "" {
+				pattern, err := regexp.Compile(name)
+				if err != nil {
+					return util.Fail("Invalid --name", "name", name, "error", err)
+				}
+				pid, err = pickProcess(ctx, pattern)
+				if err != nil {
+					return err
+				}
+			}
+
+			chat, err := tg.GetChat(tgTo)
+			if err != nil {
+				return err
+			}
+
+			result, err := tg.WaitProcess(ctx, pid)
+			if errors.Is(err, context.Canceled) {
+				os.Exit(130)
+			} else if err != nil {
+				return err
+			}
+
+			_, err = tg.SendText(chat, result.Message(), tg.TextOptions{Queue: true})
+			if errors.Is(err, tg.ErrQueued) {
+				fmt.Fprintf(os.Stderr, "Cannot send now, queued in outbox: %s\n", err)
+				return nil
+			}
+			return err
+		},
+	}
+	tgWaitCmd.Flags().IntP("pid", "p", 0, "PID of the process")
+	tgWaitCmd.Flags().StringP("name", "n", "", "Regular expression to match the command line of the process")
+	tgWaitCmd.MarkFlagsMutuallyExclusive("pid", "name")
+	tgWaitCmd.MarkFlagsOneRequired("pid", "name")
+
+	tgCmd.AddCommand(&tgWaitCmd)
+
+	tgRecvCmd := cobra.Command{
+		Use:   "recv",
+		Short: "Receive a file sent to the chat",
+		Long:  `Wait for the next document or photo sent to the chat, download it by its original name, and print its path. Exits with 124 on timeout.`,
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			dir, _ := cmd.Flags().GetString("dir")
+			timeout, _ := cmd.Flags().GetDuration("timeout")
+
+			chat, err := tg.GetChat(tgTo)
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+			defer stop()
+
+			path, err := tg.Receive(ctx, chat, dir, timeout)
+			if errors.Is(err, tg.ErrTimeout) {
+				fmt.Fprintf(os.Stderr, "Timeout after %s\n", timeout)
+				os.Exit(124)
+			} else if errors.Is(err, context.Canceled) {
+				os.Exit(130)
+			} else if err != nil {
+				return err
+			}
+
+			fmt.Println(path)
+			return nil
+		},
+	}
+	tgRecvCmd.Flags().StringP("dir", "d", ".", "Directory to save the file in")
+	tgRecvCmd.Flags().DurationP("timeout", "t", 6*time.Hour, "Duration to wait before timeout")
+
+	tgCmd.AddCommand(&tgRecvCmd)
+}
+
+// Find the process whose command line matches the pattern, picking one if there are several.
+func pickProcess(ctx context.Context, pattern *regexp.Regexp) (int, error) {
+	found, err := tg.FindProcesses(pattern)
+	if err != nil {
+		return 0, err
+	}
+
+	switch len(found) {
+	case 0:
+		return 0, util.Fail("No process is found", "name", pattern)
+	case 1:
+		return found[0].Pid, nil
+	}
+
+	processes := make(chan tg.ProcessInfo)
+	go func() {
+		defer close(processes)
+		for _, info := range found {
+			processes <- info
+		}
+	}()
+
+	return util.FzfGetFromChan(ctx, processes, func(info tg.ProcessInfo) (util.FzfLine[int], error) {
+		pid := strconv.Itoa(info.Pid)
+		return util.FzfLine[int]{Key: pid, Pretty: []string{pid, info.Cmdline}, Raw: info.Pid}, nil
+	}, util.FzfOptions{Header: []string{"Several processes match, pick one to wait for"}, Align: true})
+}
+
+// Add flags overriding the send options of the chat in config.
+func addSendOptionFlags(cmd *cobra.Command) {
+	cmd.Flags().BoolP("silent", "s", false, "Send without a notification sound")
+	cmd.Flags().Bool("protect", false, "Forbid forwarding and saving the message")
+	cmd.Flags().Int64("thread", 0, "ID of the topic to send to in a forum group")
+	cmd.Flags().Int64("reply-to", 0, "ID of the message to reply to")
+	cmd.Flags().Bool("no-preview", false, "Disable link previews")
+}
+
+// Override the send options with the flags given.
+func readSendOptionFlags(cmd *cobra.Command, opts *tg.SendOptions) {
+	flags := cmd.Flags()
+	if flags.Changed("silent") {
+		opts.Silent, _ = flags.GetBool("silent")
+	}
+	if flags.Changed("protect") {
+		opts.Protect, _ = flags.GetBool("protect")
+	}
+	if flags.Changed("thread") {
+		opts.ThreadId, _ = flags.GetInt64("thread")
+	}
+	if flags.Changed("reply-to") {
+		opts.ReplyTo, _ = flags.GetInt64("reply-to")
+	}
+	if flags.Changed("no-preview") {
+		opts.NoPreview, _ = flags.GetBool("no-preview")
+	}
+}
+
+// Render a template with `key=value` variables, and the message given in arguments if any.
+func renderTemplate(name string, varFlags []string, args []string) (string, error) {
+	vars := make(map[string]string)
+	if len(args) > 0 {
+		message, err := readMessage(args)
+		if err != nil {
+			return "", err
+		}
+		vars["message"] = message
+	}
+	for _, v := range varFlags {
+		key, value, ok := strings.Cut(v, "=")
+		if !ok || key == "" {
+			return "", util.Fail("Invalid --var, expected key=value", "var", v)
+		}
+		vars[key] = value
+	}
+
+	message, err := tg.RenderTemplate(name, vars)
+	if err != nil {
+		slog.Error("Cannot render template", "template", name, "error", err)
+		return "", err
+	}
+	return message, nil
+}
+
+// Get the message from the arguments, or stdin if there is none or it is "-".
+func readMessage(args []string) (string, error) {
+	if len(args) > 0 && !(len(args) == 1 && args[0] == "-") {
+		return strings.Join(args, " "), nil
+	}
+
+	if len(args) == 0 && term.IsTerminal(int(os.Stdin.Fd())) {
+		return "Hello, world!", nil
+	}
+
+	input, err := io.ReadAll(os.Stdin)
+	if err != nil {
+		return "", err
+	}
+
+	message := strings.TrimRight(string(input), "\n")
+	if strings.TrimSpace(message) == "" {
+		return "", util.Fail("Message from stdin is empty")
+	}
+	return message, nil
 }
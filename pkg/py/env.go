@@ -3,12 +3,17 @@ package py
 import (
 	"bufio"
 	"container/list"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strings"
+	"unicode/utf8"
 
+	"github.com/charmbracelet/lipgloss"
 	"github.com/yixuan-wang/tyw/pkg/util"
 )
 
@@ -16,7 +21,8 @@ import (
 // identified by the presence of a pyvenv.cfg file.
 //
 // The root directory should be guaranteed to exist and be a directory.
-func walkDirForVenv(root string, out chan<- string) error {
+// The walk stops early when the context is done.
+func walkDirForVenv(ctx context.Context, root string, out chan<- string) error {
 	defer close(out)
 	queue := list.New()
 	queue.PushBack(root)
@@ -43,7 +49,11 @@ func walkDirForVenv(root string, out chan<- string) error {
 				return err
 			}
 		} else {
-			out <- dir
+			select {
+			case out <- dir:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 		}
 	}
 
@@ -54,11 +64,14 @@ type VenvInfo struct {
 	Home    string
 	Version string
 	Prompt  string
+	// The tool creating the venv, `uv`, `virtualenv` or `venv`
+	Creator string
 }
 
 var regexHome = regexp.MustCompile(`^home\s*=\s*(.*)`)
 var regexVersion = regexp.MustCompile(`^version(?:_info)?\s*=\s*(.*)`)
 var regexPrompt = regexp.MustCompile(`^prompt\s*=\s*(.*)`)
+var regexCreator = regexp.MustCompile(`^(uv|virtualenv)\s*=`)
 
 func getVenvInfo(prefix string) (VenvInfo, error) {
 	file, err := os.Open(filepath.Join(prefix, "pyvenv.cfg"))
@@ -68,7 +81,7 @@ func getVenvInfo(prefix string) (VenvInfo, error) {
 	defer file.Close()
 
 	scanner := bufio.NewScanner(file)
-	var info VenvInfo
+	info := VenvInfo{Creator: "venv"}
 
 	for scanner.Scan() {
 		line := scanner.Text()
@@ -78,6 +91,8 @@ func getVenvInfo(prefix string) (VenvInfo, error) {
 			info.Version = matches[1]
 		} else if matches := regexPrompt.FindStringSubmatch(line); len(matches) > 1 {
 			info.Prompt = matches[1]
+		} else if matches := regexCreator.FindStringSubmatch(line); len(matches) > 1 {
+			info.Creator = matches[1]
 		}
 	}
 
@@ -99,7 +114,7 @@ func ListEnv() error {
 
 	dirs := make(chan string)
 	go func() {
-		if err := walkDirForVenv(envHome, dirs); err != nil {
+		if err := walkDirForVenv(context.Background(), envHome, dirs); err != nil {
 			slog.Error("Failed to walk directory", "path", envHome, "error", err)
 			return
 		}
@@ -141,6 +156,11 @@ func genEnvActivateCmd(envPath string, shell string) string {
 }
 
 // Given an environment name, print the command to activate the environment
+//
+// The name is first tried as a path relative to `env.home`. Otherwise it is
+// matched against all discovered environments and their prompts, preferring
+// exact, then prefix, then fuzzy matches. If several environments match
+// equally well, `fzf` is opened pre-filtered with the name.
 func UseEnv(name string) error {
 	envHome := pyConfig.GetString("env.home")
 
@@ -151,25 +171,182 @@ func UseEnv(name string) error {
 
 	env := filepath.Join(envHome, name)
 
-	// Check if the path exists
-	if envStat, err := os.Stat(env); os.IsNotExist(err) || !envStat.IsDir() {
-		slog.Error("Path does not exist or is not a directory", "path", env)
+	if envStat, err := os.Stat(env); err == nil && envStat.IsDir() {
+		if envVariation, ok := findVenvIn(env); ok {
+			// Print the command to activate the environment
+			fmt.Printf("%s", genEnvActivateCmd(envVariation, ""))
+			return nil
+		}
+	}
+
+	// Check if the env home exists
+	if envStat, err := os.Stat(envHome); os.IsNotExist(err) || !envStat.IsDir() {
+		slog.Error("Environment home does not exist or is not a directory", "path", envHome)
+		return nil
+	}
+
+	venvDirs := make(chan string)
+	go func() {
+		if err := walkDirForVenv(context.Background(), envHome, venvDirs); err != nil {
+			slog.Error("Failed to walk directory", "path", envHome, "error", err)
+			return
+		}
+	}()
+
+	var venvs []string
+	for dir := range venvDirs {
+		venvs = append(venvs, dir)
+	}
+
+	matches := matchEnv(envHome, name, venvs)
+	switch len(matches) {
+	case 0:
+		slog.Error("Environment does not exist", "name", name)
+		return nil
+	case 1:
+		fmt.Printf("%s", genEnvActivateCmd(matches[0], ""))
+		return nil
+	}
+
+	slog.Info("Environment name is ambiguous", "name", name, "matches", len(matches))
+
+	candidates := make(chan string)
+	go func() {
+		defer close(candidates)
+		for _, dir := range matches {
+			candidates <- dir
+		}
+	}()
+
+	fzf, err := util.FzfGetFromChan(context.Background(), candidates, venvFzfLine(envHome), util.FzfOptions{Query: name, Align: true})
+	if errors.Is(err, util.ErrFzfCancelled) || errors.Is(err, util.ErrFzfNoMatch) {
+		slog.Info("No environment is selected", "reason", err)
+		return nil
+	} else if err != nil {
+		slog.Error("Failed to initialize fzf", "error", err)
 		return nil
 	}
 
+	fmt.Printf("%s", genEnvActivateCmd(fzf, ""))
+	return nil
+}
 
+// Find the Python venv at the given directory, or in its `.venv` or `venv` subdirectory.
+func findVenvIn(dir string) (string, bool) {
 	for _, suffix := range []string{"", ".venv", "venv"} {
-		envVariation := filepath.Join(env, suffix)
+		envVariation := filepath.Join(dir, suffix)
 		if _, err := os.Stat(filepath.Join(envVariation, "pyvenv.cfg")); err == nil {
-			// Print the command to activate the environment
-			fmt.Printf("%s", genEnvActivateCmd(envVariation, ""))
-			return nil
+			return envVariation, true
 		}
 	}
+	return "", false
+}
 
+// How well a name matches a venv, higher is better.
+const (
+	matchNone = iota
+	matchFuzzy
+	matchPrefix
+	matchExact
+)
 
-	slog.Error("Environment does not exist", "name", name)
-	return nil
+// Return the venvs that match the name best.
+//
+// A venv is matched by its path relative to the env home, that path without a
+// trailing `.venv` or `venv`, and the prompt in its `pyvenv.cfg`.
+func matchEnv(envHome string, name string, venvs []string) []string {
+	best := matchNone
+	var matches []string
+
+	for _, venv := range venvs {
+		relPath, err := filepath.Rel(envHome, venv)
+		if err != nil {
+			continue
+		}
+
+		candidates := []string{relPath}
+		if base := filepath.Base(relPath); base == ".venv" || base == "venv" {
+			candidates = append(candidates, filepath.Dir(relPath))
+		}
+		if info, err := getVenvInfo(venv); err == nil && info.Prompt != "" {
+			candidates = append(candidates, info.Prompt)
+		}
+
+		score := matchNone
+		for _, candidate := range candidates {
+			score = max(score, matchName(name, candidate))
+		}
+
+		switch {
+		case score == matchNone || score < best:
+			continue
+		case score > best:
+			best = score
+			matches = []string{venv}
+		default:
+			matches = append(matches, venv)
+		}
+	}
+
+	return matches
+}
+
+// Match a name against a candidate, case-insensitively.
+//
+// A fuzzy match is when all characters of the name appear in order in the candidate.
+func matchName(name string, candidate string) int {
+	name = strings.ToLower(name)
+	candidate = strings.ToLower(candidate)
+
+	switch {
+	case name == candidate:
+		return matchExact
+	case strings.HasPrefix(candidate, name):
+		return matchPrefix
+	}
+
+	rest := candidate
+	for _, r := range name {
+		i := strings.IndexRune(rest, r)
+		if i < 0 {
+			return matchNone
+		}
+		rest = rest[i+utf8.RuneLen(r):]
+	}
+	return matchFuzzy
+}
+
+// Styles of the name, version and creator columns in the picker.
+var venvColumnStyles = []lipgloss.Style{
+	lipgloss.NewStyle().Bold(true),
+	lipgloss.NewStyle().Foreground(lipgloss.Color("6")),
+	lipgloss.NewStyle().Faint(true),
+}
+
+// Build the `fzf` line of a venv, keyed by its path relative to the env home.
+func venvFzfLine(envHome string) func(string) (util.FzfLine[string], error) {
+	return func(path string) (util.FzfLine[string], error) {
+		relPath, _ := filepath.Rel(envHome, path)
+		info, err := getVenvInfo(path)
+		if err != nil {
+			slog.Error("Failed to get venv info", "path", path, "error", err)
+			return util.FzfLine[string]{}, err
+		}
+
+		var line util.FzfLine[string]
+		line.Key = relPath
+		line.Raw = path
+
+		// Show the whole relative path, as the picker filters on what is shown,
+		// and `proj/.venv` is matched by `proj`
+		if info.Prompt != "" && info.Prompt != filepath.Base(relPath) {
+			line.Pretty = []string{fmt.Sprintf("%s(%s)", info.Prompt, relPath), info.Version, info.Creator}
+		} else {
+			line.Pretty = []string{relPath, info.Version, info.Creator}
+		}
+		line.Styles = venvColumnStyles
+		return line, nil
+	}
 }
 
 // List all Python virtual environments, pipe to `fzf` for selection
@@ -186,36 +363,23 @@ func SelectEnv() error {
 	// A Python venv is a directory with the file pyvenv.cfg
 	// Walk through all subdirectories and check if they are Python venvs
 
+	// Stop walking once the selection is made or aborted
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
 	venvDirs := make(chan string)
 	go func() {
-		if err := walkDirForVenv(envHome, venvDirs); err != nil {
+		if err := walkDirForVenv(ctx, envHome, venvDirs); err != nil && !errors.Is(err, context.Canceled) {
 			slog.Error("Failed to walk directory", "path", envHome, "error", err)
 			return
 		}
 	}()
 
-	fzf, err := util.FzfGetFromChan(venvDirs, func(path string) (util.FzfLine[string], error) {
-		relPath, _ := filepath.Rel(envHome, path)
-		info, err := getVenvInfo(path)
-		if err != nil {
-			slog.Error("Failed to get venv info", "path", path, "error", err)
-			return util.FzfLine[string]{}, err
-		}
-
-		var line util.FzfLine[string]
-		line.Key = relPath
-		line.Raw = path
-
-		name := filepath.Base(relPath)
-
-		if info.Prompt != "" && info.Prompt != name {
-			line.Pretty = []string{fmt.Sprintf("%s(%s)", info.Prompt, relPath), info.Version}
-		} else {
-			line.Pretty = []string{name, info.Version}
-		}
-		return line, nil
-	})
-	if err != nil {
+	fzf, err := util.FzfGetFromChan(ctx, venvDirs, venvFzfLine(envHome), util.FzfOptions{Align: true})
+	if errors.Is(err, util.ErrFzfCancelled) || errors.Is(err, util.ErrFzfNoMatch) {
+		slog.Info("No environment is selected", "reason", err)
+		return nil
+	} else if err != nil {
 		slog.Error("Failed to initialize fzf", "error", err)
 		return nil
 	}
@@ -0,0 +1,141 @@
+package tg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+)
+
+// Ask a question with a button for each choice, and wait for one to be pressed.
+//
+// Returns the index of the chosen one, or `ErrTimeout` if none is chosen in time.
+// The message is edited to show the choice, or that it has timed out.
+func Ask(
+	ctx context.Context,
+	chat Chat,
+	question string,
+	choices []string,
+	timeout time.Duration,
+) (int, error) {
+	client := chat.Client()
+
+	buttons := make([][]TgInlineKeyboardButton, len(choices))
+	for i, choice := range choices {
+		buttons[i] = []TgInlineKeyboardButton{{Text: choice, CallbackData: strconv.Itoa(i)}}
+	}
+
+	request := chat.message(question)
+	request.ReplyMarkup = &TgInlineKeyboardMarkup{InlineKeyboard: buttons}
+	message, err := client.SendMessage(ctx, request)
+	if err != nil {
+		slog.Error("Cannot send question", "chatId", chat.Id, "error", err)
+		return -1, err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	chosen := -1
+	err = pollUpdates(waitCtx, client, []string{"callback_query"}, func(update TgUpdate) bool {
+		query := update.CallbackQuery
+		if query == nil || query.Message == nil || query.Message.Id != message.Id || !chat.Matches(query.Message.Chat) {
+			return false
+		}
+
+		index, err := strconv.Atoi(query.Data)
+		if err != nil || index < 0 || index >= len(choices) {
+			slog.Warn("Received unknown choice", "data", query.Data)
+			return false
+		}
+
+		if err := client.AnswerCallbackQuery(ctx, AnswerCallbackQueryRequest{
+			CallbackQueryId: query.Id,
+			Text:            choices[index],
+		}); err != nil {
+			slog.Warn("Cannot answer callback query", "error", err)
+		}
+
+		slog.Debug("Received choice", "choice", choices[index], "from", query.From.Id)
+		chosen = index
+		return true
+	})
+
+	result := ""
+	switch {
+	case err == nil:
+		result = fmt.Sprintf("%s\n\n→ %s", question, choices[chosen])
+	case errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil:
+		result = fmt.Sprintf("%s\n\n(timed out after %s)", question, timeout)
+		err = ErrTimeout
+	default:
+		result = fmt.Sprintf("%s\n\n(cancelled)", question)
+	}
+
+	// Editing without a reply markup removes the buttons
+	if _, editErr := client.EditMessageText(context.WithoutCancel(ctx), EditMessageTextRequest{
+		ChatId:    chat.Id,
+		MessageId: message.Id,
+		Text:      result,
+	}); editErr != nil {
+		slog.Warn("Cannot edit question", "error", editErr)
+	}
+
+	return chosen, err
+}
+
+// Ask for a free-text reply, and wait for a reply to the prompt from the chat.
+//
+// Returns the text replied, or `ErrTimeout` if there is no reply in time.
+// With `cleanup`, both the prompt and the reply are deleted afterwards.
+func AskText(
+	ctx context.Context,
+	chat Chat,
+	prompt string,
+	cleanup bool,
+	timeout time.Duration,
+) (string, error) {
+	client := chat.Client()
+
+	request := chat.message(prompt)
+	request.ReplyMarkup = &TgForceReply{ForceReply: true}
+	message, err := client.SendMessage(ctx, request)
+	if err != nil {
+		slog.Error("Cannot send prompt", "chatId", chat.Id, "error", err)
+		return "", err
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var reply *TgMessage
+	err = pollUpdates(waitCtx, client, []string{"message"}, func(update TgUpdate) bool {
+		m := update.Message
+		if m == nil || m.ReplyToMessage == nil || m.ReplyToMessage.Id != message.Id || !chat.Matches(m.Chat) {
+			return false
+		}
+
+		slog.Debug("Received reply", "messageId", m.Id)
+		reply = m
+		return true
+	})
+
+	if cleanup {
+		messageIds := []int64{message.Id}
+		if reply != nil {
+			messageIds = append(messageIds, reply.Id)
+		}
+		if err := client.DeleteMessages(context.WithoutCancel(ctx), DeleteMessagesRequest{ChatId: chat.Id, MessageIds: messageIds}); err != nil {
+			slog.Warn("Cannot clean up messages", "error", err)
+		}
+	}
+
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		return "", ErrTimeout
+	} else if err != nil {
+		return "", err
+	}
+	return reply.Text, nil
+}
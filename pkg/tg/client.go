@@ -0,0 +1,297 @@
+package tg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const defaultApiUrl = "https://api.telegram.org"
+
+// A client of the Telegram Bot API.
+type Client struct {
+	Token string
+	// Base URL of the Bot API server, e.g. a self-hosted one.
+	ApiUrl string
+	Http   *http.Client
+	// Why the token cannot be read from config, returned by every call.
+	tokenErr error
+}
+
+// Create a client of a bot in `[tg.bots]`, or the default bot in `[tg]` if the name is empty.
+//
+// A bot without its own `api_url` uses the one in `[tg]`.
+// If the token cannot be read, calls of the client fail with the reason.
+func NewClient(bot string) *Client {
+	botConfig := tgConfig
+	apiUrl := tgConfig.GetString("api_url")
+
+	if bot != "" {
+		if botConfig = tgConfig.Sub("bots." + bot); botConfig != nil {
+			if botApiUrl := botConfig.GetString("api_url"); botApiUrl != "" {
+				apiUrl = botApiUrl
+			}
+		} else {
+			slog.Warn("No bot found in config, using default", "bot", bot)
+			bot, botConfig = "", tgConfig
+		}
+	}
+
+	if apiUrl == "" {
+		apiUrl = defaultApiUrl
+	}
+
+	token, err := cachedToken(bot, botConfig)
+	if err != nil {
+		slog.Error("Cannot read token", "bot", bot, "error", err)
+	}
+
+	return &Client{
+		Token:    token,
+		ApiUrl:   apiUrl,
+		Http:     http.DefaultClient,
+		tokenErr: err,
+	}
+}
+
+// Hide the token in a string, such as a URL, before logging or returning it.
+func (c *Client) redact(s string) string {
+	if c.Token == "" {
+		return s
+	}
+	return strings.ReplaceAll(s, c.Token, "<token>")
+}
+
+// Hide the token in the URL of an error from the HTTP client.
+func (c *Client) redactError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		urlErr.URL = c.redact(urlErr.URL)
+	}
+	return err
+}
+
+// An error returned by the Bot API with `ok: false`.
+type ApiError struct {
+	Method      string
+	Code        int
+	Description string
+	// Seconds to wait before retrying, set when flood control is exceeded.
+	RetryAfter int
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("telegram %s failed with %d: %s", e.Method, e.Code, e.Description)
+}
+
+type TgResponseParameters struct {
+	MigrateToChatId int64 `json:"migrate_to_chat_id,omitempty"`
+	RetryAfter      int   `json:"retry_after,omitempty"`
+}
+
+type TgResponse[T any] struct {
+	Ok          bool                  `json:"ok"`
+	Result      T                     `json:"result"`
+	ErrorCode   int                   `json:"error_code,omitempty"`
+	Description string                `json:"description,omitempty"`
+	Parameters  *TgResponseParameters `json:"parameters,omitempty"`
+}
+
+func (c *Client) methodUrl(method string) string {
+	fullUrl, _ := url.JoinPath(strings.TrimSuffix(c.ApiUrl, "/"), "bot"+c.Token, method)
+	return fullUrl
+}
+
+// Call a Bot API method with a JSON request, decoding the result into T.
+func call[T any](ctx context.Context, c *Client, method string, request any) (T, error) {
+	var zero T
+
+	body, err := json.Marshal(request)
+	if err != nil {
+		slog.Error("Cannot serialize request", "method", method, "error", err)
+		return zero, err
+	}
+
+	url := c.methodUrl(method)
+	slog.Debug("Calling method", "method", method, "url", c.redact(url), "body", string(body))
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return zero, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return do[T](c, method, req)
+}
+
+// Flood control waits up to this long are retried automatically, for requests that can be resent.
+const (
+	maxFloodRetries = 3
+	maxFloodWait    = 60 * time.Second
+)
+
+// Send a prepared request of a Bot API method, decoding the result into T.
+//
+// Sending methods wait for the rate limit shared by processes using the bot.
+// When Telegram asks to retry later, all of them hold off, and the request is
+// sent again if it is not waiting too long and its body can be replayed.
+func do[T any](c *Client, method string, req *http.Request) (T, error) {
+	var zero T
+
+	if c.tokenErr != nil {
+		if req.Body != nil {
+			req.Body.Close()
+		}
+		return zero, c.tokenErr
+	}
+
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if rateLimitedMethods[method] {
+			if err := c.waitForRate(ctx); err != nil {
+				return zero, err
+			}
+		}
+
+		result, err := doOnce[T](c, method, req)
+
+		var apiErr *ApiError
+		if !errors.As(err, &apiErr) || apiErr.RetryAfter <= 0 {
+			return result, err
+		}
+
+		wait := time.Duration(apiErr.RetryAfter) * time.Second
+		c.blockFor(wait)
+		if attempt >= maxFloodRetries || wait > maxFloodWait || req.GetBody == nil {
+			return result, err
+		}
+
+		slog.Warn("Flood control exceeded, retrying", "method", method, "retryAfter", wait)
+		body, bodyErr := req.GetBody()
+		if bodyErr != nil {
+			return result, err
+		}
+		req.Body = body
+
+		select {
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Send a prepared request once, decoding the result into T.
+func doOnce[T any](c *Client, method string, req *http.Request) (T, error) {
+	var zero T
+
+	resp, err := c.Http.Do(req)
+	if err != nil {
+		err = c.redactError(err)
+		slog.Error("Cannot call method", "method", method, "error", err)
+		return zero, err
+	}
+	defer resp.Body.Close()
+
+	slog.Debug("Received response", "method", method, "status", resp.StatusCode)
+
+	var response TgResponse[T]
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		slog.Error("Cannot decode response", "method", method, "status", resp.StatusCode, "error", err)
+		return zero, err
+	}
+
+	if !response.Ok {
+		apiErr := &ApiError{
+			Method:      method,
+			Code:        response.ErrorCode,
+			Description: response.Description,
+		}
+		if response.Parameters != nil {
+			apiErr.RetryAfter = response.Parameters.RetryAfter
+		}
+		return zero, apiErr
+	}
+
+	return response.Result, nil
+}
+
+type SendMessageRequest struct {
+	ChatId string `json:"chat_id"`
+	// The topic of a forum group, the general one if zero.
+	MessageThreadId     int64                 `json:"message_thread_id,omitempty"`
+	Text                string                `json:"text"`
+	ParseMode           string                `json:"parse_mode,omitempty"`
+	LinkPreviewOptions  *TgLinkPreviewOptions `json:"link_preview_options,omitempty"`
+	DisableNotification bool                  `json:"disable_notification,omitempty"`
+	ProtectContent      bool                  `json:"protect_content,omitempty"`
+	ReplyParameters     *TgReplyParameters    `json:"reply_parameters,omitempty"`
+	// Either `*TgInlineKeyboardMarkup` or `*TgForceReply`.
+	ReplyMarkup any `json:"reply_markup,omitempty"`
+}
+
+func (c *Client) SendMessage(ctx context.Context, request SendMessageRequest) (TgMessage, error) {
+	return call[TgMessage](ctx, c, "sendMessage", request)
+}
+
+type GetUpdatesRequest struct {
+	Offset         int64    `json:"offset,omitempty"`
+	Limit          int      `json:"limit,omitempty"`
+	Timeout        int      `json:"timeout,omitempty"`
+	AllowedUpdates []string `json:"allowed_updates,omitempty"`
+}
+
+func (c *Client) GetUpdates(ctx context.Context, request GetUpdatesRequest) ([]TgUpdate, error) {
+	return call[[]TgUpdate](ctx, c, "getUpdates", request)
+}
+
+type DeleteMessagesRequest struct {
+	ChatId     string  `json:"chat_id"`
+	MessageIds []int64 `json:"message_ids"`
+}
+
+func (c *Client) DeleteMessages(ctx context.Context, request DeleteMessagesRequest) error {
+	_, err := call[bool](ctx, c, "deleteMessages", request)
+	return err
+}
+
+func (c *Client) GetMe(ctx context.Context) (TgUser, error) {
+	return call[TgUser](ctx, c, "getMe", struct{}{})
+}
+
+type EditMessageTextRequest struct {
+	ChatId      string                  `json:"chat_id"`
+	MessageId   int64                   `json:"message_id"`
+	Text        string                  `json:"text"`
+	ParseMode   string                  `json:"parse_mode,omitempty"`
+	ReplyMarkup *TgInlineKeyboardMarkup `json:"reply_markup,omitempty"`
+}
+
+func (c *Client) EditMessageText(ctx context.Context, request EditMessageTextRequest) (TgMessage, error) {
+	return call[TgMessage](ctx, c, "editMessageText", request)
+}
+
+type GetFileRequest struct {
+	FileId string `json:"file_id"`
+}
+
+func (c *Client) GetFile(ctx context.Context, request GetFileRequest) (TgFile, error) {
+	return call[TgFile](ctx, c, "getFile", request)
+}
+
+type AnswerCallbackQueryRequest struct {
+	CallbackQueryId string `json:"callback_query_id"`
+	Text            string `json:"text,omitempty"`
+}
+
+func (c *Client) AnswerCallbackQuery(ctx context.Context, request AnswerCallbackQueryRequest) error {
+	_, err := call[bool](ctx, c, "answerCallbackQuery", request)
+	return err
+}
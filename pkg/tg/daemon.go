@@ -0,0 +1,310 @@
+package tg
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Number of recent updates replayed to a new subscriber, so that updates
+// arriving between sending a message and subscribing are not missed.
+const daemonBacklogSize = 256
+
+// The first line a subscriber sends to the daemon.
+type daemonSubscription struct {
+	AllowedUpdates []string `json:"allowed_updates"`
+}
+
+// The directory of runtime files, under `$XDG_RUNTIME_DIR`, or the temporary directory.
+func runtimeDir() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "tyw")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("tyw-%d", os.Getuid()))
+}
+
+// The path of a runtime file of the bot of the client, such as the socket of its daemon.
+//
+// It is named by a hash of the token so that each bot has its own files.
+func (c *Client) runtimePath(suffix string) string {
+	hash := sha256.Sum256([]byte(c.ApiUrl + "\n" + c.Token))
+	return filepath.Join(runtimeDir(), "tg-"+hex.EncodeToString(hash[:8])+suffix)
+}
+
+// The path of the Unix socket of the daemon for the bot of the client.
+func (c *Client) daemonSocket() string {
+	return c.runtimePath(".sock")
+}
+
+// The updates the daemon polls, every type handled by `TgUpdate.kind`.
+//
+// Always given explicitly, since Telegram otherwise reuses the list of the last
+// `getUpdates`, and its default leaves out reactions.
+var daemonAllowedUpdates = []string{"message", "channel_post", "message_reaction", "my_chat_member", "callback_query"}
+
+// The type of an update as in `allowed_updates`.
+func (update TgUpdate) kind() string {
+	switch {
+	case update.Message != nil:
+		return "message"
+	case update.ChannelPost != nil:
+		return "channel_post"
+	case update.MessageReaction != nil:
+		return "message_reaction"
+	case update.MyChatMember != nil:
+		return "my_chat_member"
+	case update.CallbackQuery != nil:
+		return "callback_query"
+	}
+	return ""
+}
+
+type daemonSubscriber struct {
+	allowed []string
+
+	// Updates not yet written to the subscriber, kept however long it is busy
+	mu      sync.Mutex
+	pending []TgUpdate
+	// Signalled when updates are added to `pending`.
+	ready chan struct{}
+}
+
+func (s *daemonSubscriber) push(update TgUpdate) {
+	s.mu.Lock()
+	s.pending = append(s.pending, update)
+	s.mu.Unlock()
+
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Take the pending updates, in order.
+func (s *daemonSubscriber) take() []TgUpdate {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := s.pending
+	s.pending = nil
+	return pending
+}
+
+func (s *daemonSubscriber) wants(update TgUpdate) bool {
+	return len(s.allowed) == 0 || slices.Contains(s.allowed, update.kind())
+}
+
+// Fans out updates to the subscribers, keeping a backlog of recent ones.
+type daemonHub struct {
+	mu          sync.Mutex
+	backlog     []TgUpdate
+	subscribers map[*daemonSubscriber]bool
+}
+
+func (h *daemonHub) subscribe(allowed []string) *daemonSubscriber {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	s := &daemonSubscriber{allowed: allowed, ready: make(chan struct{}, 1)}
+	for _, update := range h.backlog {
+		if s.wants(update) {
+			s.push(update)
+		}
+	}
+	h.subscribers[s] = true
+	return s
+}
+
+func (h *daemonHub) unsubscribe(s *daemonSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, s)
+}
+
+func (h *daemonHub) publish(update TgUpdate) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.backlog = append(h.backlog, update)
+	if len(h.backlog) > daemonBacklogSize {
+		h.backlog = h.backlog[len(h.backlog)-daemonBacklogSize:]
+	}
+
+	for s := range h.subscribers {
+		if s.wants(update) {
+			s.push(update)
+		}
+	}
+}
+
+// Stream updates to a subscriber connection until it disconnects.
+func (h *daemonHub) serve(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	line, err := reader.ReadBytes('\n')
+	if err != nil {
+		slog.Warn("Cannot read subscription", "error", err)
+		return
+	}
+
+	var subscription daemonSubscription
+	if err := json.Unmarshal(line, &subscription); err != nil {
+		slog.Warn("Invalid subscription", "error", err)
+		return
+	}
+
+	s := h.subscribe(subscription.AllowedUpdates)
+	defer h.unsubscribe(s)
+	slog.Info("Subscriber connected", "allowedUpdates", subscription.AllowedUpdates)
+
+	// Notice the subscriber leaving, as it never writes again
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		reader.WriteTo(io.Discard)
+	}()
+
+	encoder := json.NewEncoder(conn)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-gone:
+			slog.Info("Subscriber disconnected")
+			return
+		case <-s.ready:
+			for _, update := range s.take() {
+				if err := encoder.Encode(update); err != nil {
+					slog.Info("Subscriber disconnected", "error", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// Run the daemon owning the update stream of the bot of the client, until the context is done.
+//
+// It is the single consumer of `getUpdates`, and waiting commands subscribe
+// to it over a Unix socket instead of polling themselves, so that they do not
+// consume updates meant for each other.
+func RunDaemon(ctx context.Context, client *Client) error {
+	path := client.daemonSocket()
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("daemon is already running at %s", path)
+	}
+	// Remove a stale socket left by a daemon not exiting cleanly
+	os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	defer listener.Close()
+
+	if err := os.Chmod(path, 0o600); err != nil {
+		return err
+	}
+	slog.Info("Daemon is listening", "socket", path)
+
+	hub := &daemonHub{subscribers: make(map[*daemonSubscriber]bool)}
+
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go hub.serve(ctx, conn)
+		}
+	}()
+
+	err = pollUpdatesDirectly(ctx, client, daemonAllowedUpdates, func(update TgUpdate) bool {
+		hub.publish(update)
+		return false
+	})
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
+
+// Connect to the daemon of the bot of the client, subscribing to the allowed updates.
+func dialDaemon(ctx context.Context, client *Client, allowed []string) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: time.Second}
+	conn, err := dialer.DialContext(ctx, "unix", client.daemonSocket())
+	if err != nil {
+		return nil, err
+	}
+
+	subscription, _ := json.Marshal(daemonSubscription{AllowedUpdates: allowed})
+	if _, err := conn.Write(append(subscription, '\n')); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Receive updates from the daemon until `handle` returns true, or the context is done.
+//
+// Returns `errDaemonGone` if the connection to the daemon is lost.
+func receiveFromDaemon(ctx context.Context, conn net.Conn, handle func(TgUpdate) bool) error {
+	defer conn.Close()
+
+	updates := make(chan TgUpdate)
+	gone := make(chan struct{})
+	go func() {
+		defer close(gone)
+		decoder := json.NewDecoder(conn)
+		for {
+			var update TgUpdate
+			if err := decoder.Decode(&update); err != nil {
+				return
+			}
+			select {
+			case updates <- update:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-gone:
+			return errDaemonGone
+		case update := <-updates:
+			if handle(update) {
+				return nil
+			}
+		}
+	}
+}
+
+var errDaemonGone = errors.New("connection to daemon is lost")
@@ -0,0 +1,47 @@
+package tg
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestDaemonKeepsUpdatesForBusySubscriber(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	hub := &daemonHub{subscribers: make(map[*daemonSubscriber]bool)}
+	daemonConn, conn := net.Pipe()
+	go hub.serve(ctx, daemonConn)
+
+	subscription, _ := json.Marshal(daemonSubscription{AllowedUpdates: []string{"message"}})
+	if _, err := conn.Write(append(subscription, '\n')); err != nil {
+		t.Fatal(err)
+	}
+	for subscribed := false; !subscribed; time.Sleep(time.Millisecond) {
+		hub.mu.Lock()
+		subscribed = len(hub.subscribers) > 0
+		hub.mu.Unlock()
+	}
+
+	// Far more updates than the backlog, while the subscriber reads none
+	const count = 2000
+	for i := range count {
+		hub.publish(TgUpdate{Id: int64(i), Message: &TgMessage{Id: int64(i)}})
+		hub.publish(TgUpdate{Id: int64(i), CallbackQuery: &TgCallbackQuery{Id: "ignored"}})
+	}
+
+	next := int64(0)
+	err := receiveFromDaemon(ctx, conn, func(update TgUpdate) bool {
+		if update.Message == nil || update.Id != next {
+			t.Fatalf("got update %+v, want message %d", update, next)
+		}
+		next++
+		return next == count
+	})
+	if err != nil {
+		t.Fatalf("received %d of %d updates: %v", next, count, err)
+	}
+}
@@ -0,0 +1,225 @@
+package tg
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Default duration in which sends are counted towards `digest_threshold`,
+// and messages are collected into a digest.
+const defaultDigestWindow = 10 * time.Second
+
+// A message in the digest spool of a chat.
+type digestEntry struct {
+	Queued int64 `json:"queued"`
+	// Name of the bot in `[tg.bots]`, for recovering the message into the outbox.
+	Bot     string             `json:"bot,omitempty"`
+	Request SendMessageRequest `json:"request"`
+}
+
+// The digest settings, `digest_threshold` being zero if disabled.
+func digestConfig() (int, time.Duration) {
+	window := defaultDigestWindow
+	if tgConfig.IsSet("digest_window") {
+		window = tgConfig.GetDuration("digest_window")
+	}
+	return tgConfig.GetInt("digest_threshold"), window
+}
+
+// Collect the message into a digest instead of sending it, if more messages than
+// `digest_threshold` have been sent within `digest_window` by processes using the bot.
+//
+// The process starting a digest waits for the window, or until interrupted, then
+// sends all messages collected as one digest. Returns whether the message is collected.
+// Digests whose process is gone are moved to the outbox by `RecoverDigests`.
+// Messages in MarkdownV2, or with a reply markup, are never collected.
+func coalesce(chat Chat, client *Client, request SendMessageRequest) (bool, error) {
+	threshold, window := digestConfig()
+	if threshold <= 0 || request.ParseMode == ParseModeMarkdownV2 || request.ReplyMarkup != nil {
+		return false, nil
+	}
+	if client.recentSends(window) < threshold {
+		return false, nil
+	}
+
+	entry, err := json.Marshal(digestEntry{Queued: time.Now().UnixNano(), Bot: chat.Bot, Request: request})
+	if err != nil {
+		return false, err
+	}
+
+	suffix := digestSuffix(request.ChatId)
+	owner := false
+	err = client.withLockedFile(suffix, func(content []byte) []byte {
+		// Nobody is sending the digest, or its sender has died
+		owner = len(content) == 0 || isStaleDigest(content, window)
+		return append(append(content, entry...), '\n')
+	})
+	if err != nil {
+		slog.Debug("Cannot collect message into digest, sending it", "error", err)
+		return false, nil
+	}
+
+	slog.Info("Collected message into digest", "chatId", request.ChatId, "owner", owner)
+	if owner {
+		// Send what is collected early rather than leave it behind when interrupted
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		select {
+		case <-ctx.Done():
+			slog.Info("Interrupted, sending digest early", "chatId", request.ChatId)
+		case <-time.After(window):
+		}
+		return true, sendDigest(chat, client, suffix)
+	}
+	return true, nil
+}
+
+// The suffix of the digest spool of a chat, in the runtime directory of the bot.
+func digestSuffix(chatId string) string {
+	safe := strings.Map(func(r rune) rune {
+		if r == '-' || r == '_' || (r >= '0' && r <= '9') || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') {
+			return r
+		}
+		return '_'
+	}, chatId)
+	return "-" + safe + ".digest"
+}
+
+// Whether the oldest message in a digest spool is overdue, so its sender must have died.
+func isStaleDigest(content []byte, window time.Duration) bool {
+	first, _, _ := bytes.Cut(content, []byte("\n"))
+	var entry digestEntry
+	if err := json.Unmarshal(first, &entry); err != nil {
+		return true
+	}
+	return time.Since(time.Unix(0, entry.Queued)) > 2*window+time.Minute
+}
+
+// Read the entries of a digest spool.
+func parseDigest(content []byte) []digestEntry {
+	var entries []digestEntry
+	for _, line := range bytes.Split(content, []byte("\n")) {
+		var entry digestEntry
+		if len(line) > 0 && json.Unmarshal(line, &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	return entries
+}
+
+// Combine the entries into as few digest messages as possible.
+//
+// The options of the first message apply to the digest.
+func digestRequests(entries []digestEntry) []SendMessageRequest {
+	header := fmt.Sprintf("📦 Digest of %d messages", len(entries))
+	var requests []SendMessageRequest
+	var current strings.Builder
+	// Number of entries in the current message
+	count := 0
+	flush := func() {
+		if count == 0 {
+			return
+		}
+		request := entries[0].Request
+		request.Text = current.String()
+		request.ParseMode = ParseModeHtml
+		request.ReplyParameters = nil
+		requests = append(requests, request)
+		current.Reset()
+		count = 0
+	}
+
+	current.WriteString(EscapeHtml(header))
+	for _, entry := range entries {
+		text := entry.Request.Text
+		if entry.Request.ParseMode != ParseModeHtml {
+			text = EscapeHtml(text)
+		}
+		if len([]rune(current.String()))+len([]rune(text))+2 > maxMessageLength {
+			if count > 0 {
+				flush()
+			} else {
+				// No room for the header beside the first entry
+				current.Reset()
+			}
+		}
+		if current.Len() > 0 {
+			current.WriteString("\n\n")
+		}
+		current.WriteString(text)
+		count++
+	}
+	flush()
+
+	return requests
+}
+
+// Take the messages in a digest spool and send them as few messages as possible.
+func sendDigest(chat Chat, client *Client, suffix string) error {
+	var entries []digestEntry
+	err := client.withLockedFile(suffix, func(content []byte) []byte {
+		entries = parseDigest(content)
+		return []byte{}
+	})
+	if err != nil || len(entries) == 0 {
+		return err
+	}
+
+	requests := digestRequests(entries)
+	ctx := context.Background()
+	for i, request := range requests {
+		if _, err := client.SendMessage(ctx, request); err != nil {
+			slog.Error("Cannot send digest", "error", err)
+			if isTransient(err) {
+				if queueErr := enqueue(chat, requests[i:], err); queueErr == nil {
+					return fmt.Errorf("%w: %w", ErrQueued, err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Move the digests left behind by processes gone before sending them into the outbox,
+// so that they are sent with it rather than lost with the runtime directory.
+func RecoverDigests() {
+	_, window := digestConfig()
+
+	paths, _ := filepath.Glob(filepath.Join(runtimeDir(), "tg-*.digest"))
+	for _, path := range paths {
+		var entries []digestEntry
+		err := withLockedPath(path, func(content []byte) []byte {
+			if len(content) == 0 || !isStaleDigest(content, window) {
+				return nil
+			}
+			entries = parseDigest(content)
+			return []byte{}
+		})
+		if err != nil {
+			slog.Warn("Cannot recover digest", "path", path, "error", err)
+			continue
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		// A spool only holds messages of one chat, each entry knows its bot
+		chat := Chat{Id: entries[0].Request.ChatId, Bot: entries[0].Bot}
+		if err := enqueue(chat, digestRequests(entries), nil); err != nil {
+			slog.Error("Cannot move digest to outbox, messages are lost", "path", path, "count", len(entries), "error", err)
+			continue
+		}
+		slog.Info("Moved stale digest to outbox", "path", path, "count", len(entries))
+	}
+}
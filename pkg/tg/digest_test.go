@@ -0,0 +1,46 @@
+package tg
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func digestOf(texts ...string) []digestEntry {
+	entries := make([]digestEntry, len(texts))
+	for i, text := range texts {
+		entries[i] = digestEntry{Request: SendMessageRequest{ChatId: "1", Text: text}}
+	}
+	return entries
+}
+
+func TestDigestRequestsCombines(t *testing.T) {
+	requests := digestRequests(digestOf("a", "<b>"))
+	if len(requests) != 1 {
+		t.Fatalf("digestRequests gave %d messages, want 1", len(requests))
+	}
+	if want := "📦 Digest of 2 messages\n\na\n\n&lt;b&gt;"; requests[0].Text != want {
+		t.Errorf("digest = %q, want %q", requests[0].Text, want)
+	}
+	if requests[0].ParseMode != ParseModeHtml {
+		t.Errorf("parse mode = %q, want HTML", requests[0].ParseMode)
+	}
+}
+
+func TestDigestRequestsNoHeaderOnly(t *testing.T) {
+	long := strings.Repeat("x", 4090)
+	requests := digestRequests(digestOf(long, "b", long))
+
+	var texts []string
+	for _, request := range requests {
+		if n := utf8.RuneCountInString(request.Text); n > maxMessageLength {
+			t.Errorf("message of %d characters is over the limit", n)
+		}
+		texts = append(texts, request.Text)
+	}
+	// The header does not fit beside the first entry, and is left out
+	if want := []string{long + "\n\nb", long}; !slices.Equal(texts, want) {
+		t.Errorf("digest has %d messages, want the entries without the header", len(texts))
+	}
+}
@@ -0,0 +1,225 @@
+package tg
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"maps"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// Upload limits of the public Bot API server, local servers allow up to 2000 MB.
+const (
+	maxUploadSize      = 50 << 20
+	maxPhotoSize       = 10 << 20
+	maxLocalUploadSize = 2000 << 20
+)
+
+// A media group holds at most this many files.
+const maxMediaGroupSize = 10
+
+// A local file to upload.
+type InputFile struct {
+	Path string
+	Size int64
+	// Whether the file is sent as a photo rather than a document.
+	Photo bool
+}
+
+// Stat a local file for upload, detecting whether it is a photo.
+//
+// Files larger than the upload limit of the Bot API server are rejected,
+// and photos larger than the photo limit are sent as documents.
+func (c *Client) StatInputFile(path string) (InputFile, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return InputFile{}, err
+	}
+	if stat.IsDir() {
+		return InputFile{}, fmt.Errorf("%s is a directory", path)
+	}
+
+	limit := int64(maxUploadSize)
+	if c.ApiUrl != defaultApiUrl {
+		limit = maxLocalUploadSize
+	}
+	if stat.Size() > limit {
+		return InputFile{}, fmt.Errorf("%s is %d MB, exceeding the upload limit of %d MB", path, stat.Size()>>20, limit>>20)
+	}
+
+	file := InputFile{Path: path, Size: stat.Size()}
+	switch detectMimeType(path) {
+	case "image/jpeg", "image/png":
+		file.Photo = stat.Size() <= maxPhotoSize
+	}
+	return file, nil
+}
+
+// Detect the MIME type of a file by its extension, falling back to its content.
+func detectMimeType(path string) string {
+	if mimeType, _, err := mime.ParseMediaType(mime.TypeByExtension(filepath.Ext(path))); err == nil {
+		return mimeType
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return "application/octet-stream"
+	}
+	defer file.Close()
+
+	head := make([]byte, 512)
+	n, _ := io.ReadFull(file, head)
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(head[:n]))
+	return mimeType
+}
+
+// A file part of a multipart request.
+type multipartFile struct {
+	Field string
+	Path  string
+}
+
+// Call a Bot API method with a multipart request, streaming the files.
+func callMultipart[T any](ctx context.Context, c *Client, method string, fields map[string]string, files []multipartFile) (T, error) {
+	reader, writer := io.Pipe()
+	form := multipart.NewWriter(writer)
+
+	go func() {
+		err := func() error {
+			for key, value := range fields {
+				if err := form.WriteField(key, value); err != nil {
+					return err
+				}
+			}
+			for _, f := range files {
+				part, err := form.CreateFormFile(f.Field, filepath.Base(f.Path))
+				if err != nil {
+					return err
+				}
+				file, err := os.Open(f.Path)
+				if err != nil {
+					return err
+				}
+				_, err = io.Copy(part, file)
+				file.Close()
+				if err != nil {
+					return err
+				}
+			}
+			return form.Close()
+		}()
+		writer.CloseWithError(err)
+	}()
+
+	url := c.methodUrl(method)
+	slog.Debug("Calling method", "method", method, "url", c.redact(url), "fields", fields, "files", files)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, reader)
+	if err != nil {
+		reader.CloseWithError(err)
+		var zero T
+		return zero, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	return do[T](c, method, req)
+}
+
+// Send a single file as a photo or a document.
+//
+// The fields hold the chat and the options, see `Chat.fileFields`.
+func (c *Client) SendFile(ctx context.Context, fields map[string]string, file InputFile, caption string) (TgMessage, error) {
+	method, field := "sendDocument", "document"
+	if file.Photo {
+		method, field = "sendPhoto", "photo"
+	}
+
+	fields = maps.Clone(fields)
+	if caption != "" {
+		fields["caption"] = caption
+	}
+
+	return callMultipart[TgMessage](ctx, c, method, fields, []multipartFile{{Field: field, Path: file.Path}})
+}
+
+type TgInputMedia struct {
+	Type    string `json:"type"`
+	Media   string `json:"media"`
+	Caption string `json:"caption,omitempty"`
+}
+
+// Send 2 to 10 files as an album. Photos and documents cannot be mixed.
+//
+// The fields hold the chat and the options, see `Chat.fileFields`.
+func (c *Client) SendMediaGroup(ctx context.Context, fields map[string]string, files []InputFile, caption string) ([]TgMessage, error) {
+	media := make([]TgInputMedia, len(files))
+	parts := make([]multipartFile, len(files))
+	for i, file := range files {
+		field := fmt.Sprintf("file%d", i)
+		media[i] = TgInputMedia{Type: "document", Media: "attach://" + field}
+		if file.Photo {
+			media[i].Type = "photo"
+		}
+		parts[i] = multipartFile{Field: field, Path: file.Path}
+	}
+	media[0].Caption = caption
+
+	jsonMedia, err := json.Marshal(media)
+	if err != nil {
+		return nil, err
+	}
+
+	fields = maps.Clone(fields)
+	fields["media"] = string(jsonMedia)
+	return callMultipart[[]TgMessage](ctx, c, "sendMediaGroup", fields, parts)
+}
+
+// Send local files to a chat, as albums when there are several of them.
+//
+// Photos and documents are grouped separately, and the caption goes with the first file.
+func SendFiles(chat Chat, paths []string, caption string) error {
+	client := chat.Client()
+	ctx := context.Background()
+
+	var photos, documents []InputFile
+	for _, path := range paths {
+		file, err := client.StatInputFile(path)
+		if err != nil {
+			slog.Error("Cannot upload file", "path", path, "error", err)
+			return err
+		}
+		if file.Photo {
+			photos = append(photos, file)
+		} else {
+			documents = append(documents, file)
+		}
+	}
+
+	for _, group := range [][]InputFile{photos, documents} {
+		for len(group) > 0 {
+			chunk := group[:min(len(group), maxMediaGroupSize)]
+			group = group[len(chunk):]
+
+			var err error
+			if len(chunk) == 1 {
+				_, err = client.SendFile(ctx, chat.fileFields(), chunk[0], caption)
+			} else {
+				_, err = client.SendMediaGroup(ctx, chat.fileFields(), chunk, caption)
+			}
+			if err != nil {
+				slog.Error("Cannot send files", "chatId", chat.Id, "error", err)
+				return err
+			}
+			caption = ""
+			chat.Options.ReplyTo = 0
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package tg
+
+import (
+	"html"
+	"strings"
+	"unicode/utf8"
+)
+
+// Parse modes of message text.
+const (
+	ParseModeNone       = ""
+	ParseModeMarkdownV2 = "MarkdownV2"
+	ParseModeHtml       = "HTML"
+)
+
+// Normalize a user-given parse mode, case-insensitively.
+func ParseParseMode(mode string) (string, bool) {
+	switch strings.ToLower(mode) {
+	case "", "none", "plain":
+		return ParseModeNone, true
+	case "markdownv2", "markdown", "md":
+		return ParseModeMarkdownV2, true
+	case "html":
+		return ParseModeHtml, true
+	}
+	return "", false
+}
+
+var markdownV2Escaper = strings.NewReplacer(
+	`\`, `\\`, "_", `\_`, "*", `\*`, "[", `\[`, "]", `\]`, "(", `\(`, ")", `\)`,
+	"~", `\~`, "`", "\\`", ">", `\>`, "#", `\#`, "+", `\+`, "-", `\-`, "=", `\=`,
+	"|", `\|`, "{", `\{`, "}", `\}`, ".", `\.`, "!", `\!`,
+)
+
+var markdownV2CodeEscaper = strings.NewReplacer(`\`, `\\`, "`", "\\`")
+
+// Escape text to appear literally in a MarkdownV2 message.
+func EscapeMarkdownV2(text string) string {
+	return markdownV2Escaper.Replace(text)
+}
+
+// Escape text to appear literally in an HTML message.
+func EscapeHtml(text string) string {
+	return html.EscapeString(text)
+}
+
+// Escape text to appear literally in a message of the parse mode.
+func Escape(text string, parseMode string) string {
+	switch parseMode {
+	case ParseModeMarkdownV2:
+		return EscapeMarkdownV2(text)
+	case ParseModeHtml:
+		return EscapeHtml(text)
+	}
+	return text
+}
+
+// Wrap text in a code block of the parse mode, escaping it.
+func CodeBlock(text string, parseMode string) string {
+	switch parseMode {
+	case ParseModeMarkdownV2:
+		return "```\n" + markdownV2CodeEscaper.Replace(text) + "\n```"
+	case ParseModeHtml:
+		return "<pre>" + EscapeHtml(text) + "</pre>"
+	}
+	return text
+}
+
+// Split text into chunks whose formatted length is within the limit,
+// preferably at line breaks.
+func splitMessage(text string, limit int, format func(string) string) []string {
+	length := func(s string) int { return utf8.RuneCountInString(format(s)) }
+
+	if length(text) <= limit {
+		return []string{format(text)}
+	}
+
+	var chunks []string
+	var current strings.Builder
+	flush := func() {
+		if current.Len() > 0 {
+			chunks = append(chunks, format(strings.TrimSuffix(current.String(), "\n")))
+			current.Reset()
+		}
+	}
+
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if length(current.String()+line) <= limit {
+			current.WriteString(line)
+			continue
+		}
+		flush()
+
+		// A single line too long is split by characters
+		for length(line) > limit {
+			runes := []rune(line)
+			n := len(runes)
+			for n > 1 && length(string(runes[:n])) > limit {
+				n = n * limit / max(limit+1, length(string(runes[:n])))
+			}
+			n = max(n, 1)
+			chunks = append(chunks, format(string(runes[:n])))
+			line = string(runes[n:])
+		}
+		current.WriteString(line)
+	}
+	flush()
+
+	return chunks
+}
@@ -0,0 +1,106 @@
+package tg
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestEscapeMarkdownV2(t *testing.T) {
+	got := EscapeMarkdownV2("a_b*c [d](e) ~`>#+-=|{}.! \\")
+	want := `a\_b\*c \[d\]\(e\) \~` + "\\`" + `\>\#\+\-\=\|\{\}\.\! \\`
+	if got != want {
+		t.Errorf("EscapeMarkdownV2 = %q, want %q", got, want)
+	}
+}
+
+func TestEscape(t *testing.T) {
+	text := `<b>&"x_y"</b>`
+	for _, tt := range []struct {
+		parseMode string
+		want      string
+	}{
+		{ParseModeNone, text},
+		{ParseModeHtml, `&lt;b&gt;&amp;&#34;x_y&#34;&lt;/b&gt;`},
+		{ParseModeMarkdownV2, `<b\>&"x\_y"</b\>`},
+	} {
+		if got := Escape(text, tt.parseMode); got != tt.want {
+			t.Errorf("Escape(%q) = %q, want %q", tt.parseMode, got, tt.want)
+		}
+	}
+}
+
+func TestCodeBlock(t *testing.T) {
+	text := "a <b> `c` \\d"
+	for _, tt := range []struct {
+		parseMode string
+		want      string
+	}{
+		{ParseModeNone, text},
+		{ParseModeHtml, "<pre>a &lt;b&gt; `c` \\d</pre>"},
+		{ParseModeMarkdownV2, "```\na <b> \\`c\\` \\\\d\n```"},
+	} {
+		if got := CodeBlock(text, tt.parseMode); got != tt.want {
+			t.Errorf("CodeBlock(%q) = %q, want %q", tt.parseMode, got, tt.want)
+		}
+	}
+}
+
+func TestSplitMessageShort(t *testing.T) {
+	format := func(s string) string { return CodeBlock(s, ParseModeHtml) }
+	got := splitMessage("a\nb", 20, format)
+	if want := []string{"<pre>a\nb</pre>"}; !slices.Equal(got, want) {
+		t.Errorf("splitMessage = %q, want %q", got, want)
+	}
+}
+
+func TestSplitMessageAtLines(t *testing.T) {
+	got := splitMessage("aaa\nbbb\nccc\nd", 8, func(s string) string { return s })
+	if want := []string{"aaa\nbbb", "ccc\nd"}; !slices.Equal(got, want) {
+		t.Errorf("splitMessage = %q, want %q", got, want)
+	}
+}
+
+func TestSplitMessageLongLine(t *testing.T) {
+	got := splitMessage("ab\n"+strings.Repeat("é", 10)+"\nc", 4, func(s string) string { return s })
+	want := []string{"ab", "éééé", "éééé", "éé\nc"}
+	if !slices.Equal(got, want) {
+		t.Errorf("splitMessage = %q, want %q", got, want)
+	}
+}
+
+func TestSplitMessageFormattedWithinLimit(t *testing.T) {
+	format := func(s string) string { return CodeBlock(s, ParseModeHtml) }
+	text := strings.Repeat("<&>\n", 100)
+
+	chunks := splitMessage(text, 50, format)
+	if len(chunks) < 2 {
+		t.Fatalf("splitMessage gave %d chunks, want several", len(chunks))
+	}
+
+	var joined []string
+	for _, chunk := range chunks {
+		if n := utf8.RuneCountInString(chunk); n > 50 {
+			t.Errorf("chunk %q has %d characters, over the limit", chunk, n)
+		}
+		inner, ok := strings.CutPrefix(chunk, "<pre>")
+		if inner, ok = strings.CutSuffix(inner, "</pre>"); !ok {
+			t.Fatalf("chunk %q is not a whole code block", chunk)
+		}
+		joined = append(joined, inner)
+	}
+	if got, want := strings.Join(joined, "\n"), EscapeHtml(strings.TrimSuffix(text, "\n")); got != want {
+		t.Errorf("chunks join to %q, want %q", got, want)
+	}
+}
+
+func TestSendTextRefusesLongFormattedText(t *testing.T) {
+	useTgConfig(t, `token = "123:default"`)
+
+	text := "<pre>" + strings.Repeat("x", maxMessageLength) + "</pre>"
+	sent, err := SendText(Chat{Id: "1"}, text, TextOptions{ParseMode: ParseModeHtml})
+	if err == nil || len(sent) > 0 {
+		t.Errorf("SendText = %v, %v, want an error without sending", sent, err)
+	}
+}
@@ -0,0 +1,188 @@
+package tg
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// Defaults of the rate limit of sending, shared by all processes using a bot.
+//
+// Telegram allows about one message per second to a chat, with short bursts.
+const (
+	defaultRateLimit = 1.0
+	defaultRateBurst = 20
+)
+
+// Methods sending or editing messages, which count towards the rate limit.
+var rateLimitedMethods = map[string]bool{
+	"sendMessage":     true,
+	"sendDocument":    true,
+	"sendPhoto":       true,
+	"sendMediaGroup":  true,
+	"editMessageText": true,
+}
+
+// At most this many recent sends are kept for detecting bursts.
+const maxRecentSends = 1024
+
+// The state of the rate limiter of a bot, in a file shared by processes.
+type limitState struct {
+	// Tokens left in the bucket, as of `Updated`.
+	Tokens  float64 `json:"tokens"`
+	Updated int64   `json:"updated"`
+	// No request is sent before this time, after Telegram asked to retry later.
+	BlockedUntil int64 `json:"blocked_until,omitempty"`
+	// Times of recent sends, oldest first.
+	Recent []int64 `json:"recent,omitempty"`
+}
+
+// Lock a runtime file of the client exclusively across processes, and call `fn`
+// with its content. The file is replaced with what `fn` returns, unless it is nil.
+func (c *Client) withLockedFile(suffix string, fn func(content []byte) []byte) error {
+	return withLockedPath(c.runtimePath(suffix), fn)
+}
+
+// Lock a file by path exclusively across processes, like `Client.withLockedFile`.
+func withLockedPath(path string, fn func(content []byte) []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	defer syscall.Flock(int(file.Fd()), syscall.LOCK_UN)
+
+	content, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+
+	updated := fn(content)
+	if updated == nil {
+		return nil
+	}
+	if err := file.Truncate(0); err != nil {
+		return err
+	}
+	_, err = file.WriteAt(updated, 0)
+	return err
+}
+
+// Read and update the rate limiter state under the lock.
+func (c *Client) withLimitState(fn func(state *limitState)) error {
+	return c.withLockedFile(".limit", func(content []byte) []byte {
+		rate, burst := rateLimit()
+		now := time.Now()
+
+		state := limitState{Tokens: burst, Updated: now.UnixNano()}
+		if len(content) > 0 {
+			if err := json.Unmarshal(content, &state); err != nil {
+				slog.Warn("Resetting corrupted rate limiter state", "error", err)
+				state = limitState{Tokens: burst, Updated: now.UnixNano()}
+			}
+		}
+
+		// Refill the bucket for the time passed
+		elapsed := now.Sub(time.Unix(0, state.Updated)).Seconds()
+		state.Tokens = min(burst, state.Tokens+max(0, elapsed)*rate)
+		state.Updated = now.UnixNano()
+
+		fn(&state)
+
+		updated, _ := json.Marshal(state)
+		return updated
+	})
+}
+
+// The rate limit in messages per second, and the burst, from `rate_limit` and `rate_burst`.
+func rateLimit() (float64, float64) {
+	rate, burst := defaultRateLimit, float64(defaultRateBurst)
+	if tgConfig.IsSet("rate_limit") {
+		rate = tgConfig.GetFloat64("rate_limit")
+	}
+	if tgConfig.IsSet("rate_burst") {
+		burst = max(1, tgConfig.GetFloat64("rate_burst"))
+	}
+	return rate, burst
+}
+
+// Wait until a message can be sent under the rate limit shared by processes using the bot.
+//
+// Without a usable runtime directory, messages are sent without limit.
+func (c *Client) waitForRate(ctx context.Context) error {
+	rate, _ := rateLimit()
+	if rate <= 0 {
+		return nil
+	}
+
+	for {
+		var wait time.Duration
+		err := c.withLimitState(func(state *limitState) {
+			now := time.Now()
+			switch {
+			case state.BlockedUntil > now.UnixNano():
+				wait = time.Duration(state.BlockedUntil - now.UnixNano())
+			case state.Tokens < 1:
+				wait = time.Duration((1 - state.Tokens) / rate * float64(time.Second))
+			default:
+				state.Tokens--
+				state.Recent = append(state.Recent, now.UnixNano())
+				if len(state.Recent) > maxRecentSends {
+					state.Recent = state.Recent[len(state.Recent)-maxRecentSends:]
+				}
+			}
+		})
+		if err != nil {
+			slog.Debug("Cannot use rate limiter, sending without limit", "error", err)
+			return nil
+		}
+		if wait <= 0 {
+			return nil
+		}
+
+		slog.Debug("Waiting for rate limit", "wait", wait)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// Hold off all processes using the bot, after Telegram asked to retry later.
+func (c *Client) blockFor(d time.Duration) {
+	until := time.Now().Add(d).UnixNano()
+	err := c.withLimitState(func(state *limitState) {
+		state.BlockedUntil = max(state.BlockedUntil, until)
+	})
+	if err != nil {
+		slog.Debug("Cannot record flood control in rate limiter", "error", err)
+	}
+}
+
+// The number of messages sent by all processes using the bot within the window.
+func (c *Client) recentSends(window time.Duration) int {
+	since := time.Now().Add(-window).UnixNano()
+	count := 0
+	c.withLimitState(func(state *limitState) {
+		for _, sent := range state.Recent {
+			if sent >= since {
+				count++
+			}
+		}
+	})
+	return count
+}
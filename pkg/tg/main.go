@@ -3,6 +3,8 @@ package tg
 import (
 	"fmt"
 	"log/slog"
+	"strconv"
+	"strings"
 
 	"github.com/spf13/viper"
 )
@@ -24,11 +26,132 @@ func InitConfig() error {
 	return nil
 }
 
-func GetChatId() (string, error) {
-	chatId := tgConfig.GetString("chat_id")
-	if chatId == "" {
-		slog.Warn("No chat_id found in config, using default")
-		return "", fmt.Errorf("no chat_id found in config")
+// A chat to send to, and the bot sending to it.
+type Chat struct {
+	// The name in `[tg.chats]`, empty for the legacy `chat_id`.
+	Name string
+	Id   string
+	// The name in `[tg.bots]`, empty for the default bot.
+	Bot     string
+	Options SendOptions
+}
+
+// Resolve a chat by its name in `[tg.chats]`.
+//
+// Without a name, `default_chat` is used, or else the top-level `chat_id`.
+// A name not configured but looking like a chat ID, e.g. `-100123` or `@channel`,
+// is used as the ID directly.
+func GetChat(name string) (Chat, error) {
+	if name == "" {
+		name = tgConfig.GetString("default_chat")
+	}
+
+	if name == "" {
+		chatId := tgConfig.GetString("chat_id")
+		if chatId == "" {
+			slog.Warn("No chat_id found in config")
+			return Chat{}, fmt.Errorf("no chat_id found in config")
+		}
+		return Chat{Id: chatId, Options: readSendOptions(tgConfig)}, nil
+	}
+
+	chatConfig := tgConfig.Sub("chats." + name)
+	if chatConfig == nil {
+		if _, err := strconv.ParseInt(name, 10, 64); err == nil || strings.HasPrefix(name, "@") {
+			return Chat{Id: name}, nil
+		}
+		return Chat{}, fmt.Errorf("no chat named %q found in config", name)
+	}
+
+	chat := Chat{
+		Name:    name,
+		Id:      chatConfig.GetString("chat_id"),
+		Bot:     chatConfig.GetString("bot"),
+		Options: readSendOptions(chatConfig),
+	}
+	if chat.Id == "" {
+		return Chat{}, fmt.Errorf("no chat_id found for chat %q", name)
+	}
+	if chat.Bot != "" && tgConfig.Sub("bots."+chat.Bot) == nil {
+		return Chat{}, fmt.Errorf("no bot named %q found in config for chat %q", chat.Bot, name)
+	}
+
+	return chat, nil
+}
+
+// Create a client of the bot sending to the chat.
+func (chat Chat) Client() *Client {
+	return NewClient(chat.Bot)
+}
+
+// Whether a chat in an update is this chat.
+func (chat Chat) Matches(tgChat TgChat) bool {
+	if username, ok := strings.CutPrefix(chat.Id, "@"); ok {
+		return strings.EqualFold(username, tgChat.Username)
+	}
+	return chat.Id == strconv.FormatInt(tgChat.Id, 10)
+}
+
+// Options of sending messages to a chat.
+//
+// Defaults are set per chat in config, e.g. `silent = true` in `[tg.chats.<name>]`.
+type SendOptions struct {
+	// Send without a notification sound.
+	Silent bool
+	// Forbid forwarding and saving the messages.
+	Protect bool
+	// The topic of a forum group.
+	ThreadId int64
+	// The message to reply to. Only the first message replies when text is split.
+	ReplyTo int64
+	// Disable link previews.
+	NoPreview bool
+}
+
+// Read the default options from the config of a chat.
+func readSendOptions(v *viper.Viper) SendOptions {
+	return SendOptions{
+		Silent:    v.GetBool("silent"),
+		Protect:   v.GetBool("protect_content"),
+		ThreadId:  v.GetInt64("thread_id"),
+		NoPreview: v.GetBool("no_preview"),
+	}
+}
+
+// A request sending text to this chat with its options.
+func (chat Chat) message(text string) SendMessageRequest {
+	opts := chat.Options
+	request := SendMessageRequest{
+		ChatId:              chat.Id,
+		MessageThreadId:     opts.ThreadId,
+		Text:                text,
+		DisableNotification: opts.Silent,
+		ProtectContent:      opts.Protect,
+	}
+	if opts.NoPreview {
+		request.LinkPreviewOptions = &TgLinkPreviewOptions{IsDisabled: true}
+	}
+	if opts.ReplyTo != 0 {
+		request.ReplyParameters = &TgReplyParameters{MessageId: opts.ReplyTo, AllowSendingWithoutReply: true}
+	}
+	return request
+}
+
+// The fields of a multipart request sending files to this chat with its options.
+func (chat Chat) fileFields() map[string]string {
+	opts := chat.Options
+	fields := map[string]string{"chat_id": chat.Id}
+	if opts.ThreadId != 0 {
+		fields["message_thread_id"] = strconv.FormatInt(opts.ThreadId, 10)
+	}
+	if opts.Silent {
+		fields["disable_notification"] = "true"
+	}
+	if opts.Protect {
+		fields["protect_content"] = "true"
+	}
+	if opts.ReplyTo != 0 {
+		fields["reply_parameters"] = fmt.Sprintf(`{"message_id":%d,"allow_sending_without_reply":true}`, opts.ReplyTo)
 	}
-	return chatId, nil
+	return fields
 }
@@ -1,82 +1,206 @@
 package tg
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"log/slog"
-	"net/http"
-	"net/url"
-	"os"
 	"time"
+	"unicode/utf8"
 )
 
+type TgUser struct {
+	Id        int64  `json:"id"`
+	IsBot     bool   `json:"is_bot"`
+	FirstName string `json:"first_name"`
+	LastName  string `json:"last_name,omitempty"`
+	Username  string `json:"username,omitempty"`
+}
+
 type TgChat struct {
-	Id       int64  `json:"id"`
-	Type     string `json:"type"`
-	Username string `json:"username"`
+	Id        int64  `json:"id"`
+	Type      string `json:"type"`
+	Title     string `json:"title,omitempty"`
+	Username  string `json:"username,omitempty"`
+	FirstName string `json:"first_name,omitempty"`
+	LastName  string `json:"last_name,omitempty"`
 }
 
 type TgMessage struct {
-	Id   int64  `json:"message_id"`
-	Date int64  `json:"date"`
-	From TgChat `json:"from"`
+	Id             int64       `json:"message_id"`
+	Date           int64       `json:"date"`
+	From           *TgUser     `json:"from,omitempty"`
+	Chat           TgChat      `json:"chat"`
+	Text           string      `json:"text,omitempty"`
+	ReplyToMessage *TgMessage  `json:"reply_to_message,omitempty"`
+	Document       *TgDocument `json:"document,omitempty"`
+	// The sizes of a photo, the largest last.
+	Photo   []TgPhotoSize `json:"photo,omitempty"`
+	Caption string        `json:"caption,omitempty"`
+}
+
+type TgDocument struct {
+	FileId       string `json:"file_id"`
+	FileUniqueId string `json:"file_unique_id"`
+	FileName     string `json:"file_name,omitempty"`
+	MimeType     string `json:"mime_type,omitempty"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+type TgPhotoSize struct {
+	FileId       string `json:"file_id"`
+	FileUniqueId string `json:"file_unique_id"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+	FileSize     int64  `json:"file_size,omitempty"`
+}
+
+type TgFile struct {
+	FileId       string `json:"file_id"`
+	FileUniqueId string `json:"file_unique_id"`
+	FileSize     int64  `json:"file_size,omitempty"`
+	// Relative to the download URL, or an absolute local path with a local Bot API server.
+	FilePath string `json:"file_path,omitempty"`
+}
+
+type TgMessageReactionUpdated struct {
+	Chat      TgChat  `json:"chat"`
+	MessageId int64   `json:"message_id"`
+	User      *TgUser `json:"user,omitempty"`
+	Date      int64   `json:"date"`
+}
+
+type TgInlineKeyboardButton struct {
+	Text         string `json:"text"`
+	CallbackData string `json:"callback_data,omitempty"`
+}
+
+type TgInlineKeyboardMarkup struct {
+	InlineKeyboard [][]TgInlineKeyboardButton `json:"inline_keyboard"`
+}
+
+type TgForceReply struct {
+	ForceReply            bool   `json:"force_reply"`
+	InputFieldPlaceholder string `json:"input_field_placeholder,omitempty"`
+}
+
+type TgReplyParameters struct {
+	MessageId int64 `json:"message_id"`
+	// Send the message even if the one to reply to is deleted.
+	AllowSendingWithoutReply bool `json:"allow_sending_without_reply,omitempty"`
+}
+
+type TgLinkPreviewOptions struct {
+	IsDisabled bool `json:"is_disabled,omitempty"`
+}
+
+type TgCallbackQuery struct {
+	Id      string     `json:"id"`
+	From    TgUser     `json:"from"`
+	Message *TgMessage `json:"message,omitempty"`
+	Data    string     `json:"data,omitempty"`
+}
+
+type TgChatMemberUpdated struct {
 	Chat TgChat `json:"chat"`
-	Text string `json:"text"`
+	From TgUser `json:"from"`
+	Date int64  `json:"date"`
 }
 
-type TgResponse[T any] struct {
-	Ok     bool   `json:"ok"`
-	Result T      `json:"result"`
+type TgUpdate struct {
+	Id              int64                     `json:"update_id"`
+	Message         *TgMessage                `json:"message,omitempty"`
+	ChannelPost     *TgMessage                `json:"channel_post,omitempty"`
+	MessageReaction *TgMessageReactionUpdated `json:"message_reaction,omitempty"`
+	MyChatMember    *TgChatMemberUpdated      `json:"my_chat_member,omitempty"`
+	CallbackQuery   *TgCallbackQuery          `json:"callback_query,omitempty"`
 }
 
-func getBotURL(path ...string) string {
-	botUrl := fmt.Sprintf("https://api.telegram.org/bot%s", tgConfig.Get("token"))
-	if len(path) > 0 {
-		fullUrl, _ := url.JoinPath(botUrl, path...)
-		return fullUrl
-	} else {
-		fullUrl, _ := url.JoinPath(botUrl, "/")
-		return fullUrl
-	}
+// Options of sending text by `SendText`.
+type TextOptions struct {
+	// One of `ParseModeNone`, `ParseModeMarkdownV2` or `ParseModeHtml`.
+	ParseMode string
+	// Wrap the text in a code block, escaping it.
+	// Without a parse mode, HTML is used.
+	Code bool
+	// Queue the messages in the outbox if they cannot be sent for now.
+	Queue bool
 }
 
-func SendMessage(
-	chatId string,
-	message string,
-) (TgMessage, error) {
-	url := getBotURL("sendMessage")
-	body, err := json.Marshal(map[string]interface{}{
-		"chat_id": chatId,
-		"text":    message,
-	})
-	if err != nil {
-		slog.Error("Cannot serialize message", "message", message, "error", err)
-		return TgMessage{}, err
+// Send text to a chat, split into several messages if it is too long.
+// Text in a parse mode is never split, which could break its markup, but `Code` text is.
+//
+// With `Queue`, the messages not sent due to a transient failure are queued,
+// and `ErrQueued` is returned.
+// In a burst above `digest_threshold`, the messages are collected into a digest instead.
+func SendText(
+	chat Chat,
+	text string,
+	opts TextOptions,
+) ([]TgMessage, error) {
+	parseMode := opts.ParseMode
+	format := func(s string) string { return s }
+	if opts.Code {
+		if parseMode == ParseModeNone {
+			parseMode = ParseModeHtml
+		}
+		format = func(s string) string { return CodeBlock(s, parseMode) }
 	}
 
-	slog.Debug("Sending message", "message", message, "url", url, "body", string(body))
-	bufBody := bytes.NewBuffer(body)
-	resp, err := http.Post(url, "application/json", bufBody)
-	if err != nil {
-		slog.Error("Cannot send message", "message", message, "error", err)
-		return TgMessage{}, err
+	if parseMode != ParseModeNone && !opts.Code {
+		if length := utf8.RuneCountInString(text); length > maxMessageLength {
+			err := fmt.Errorf("text in %s is %d characters, longer than %d, and cannot be split safely", parseMode, length, maxMessageLength)
+			slog.Error("Cannot send message", "error", err)
+			return nil, err
+		}
 	}
-	defer resp.Body.Close()
 
-	slog.Debug("Received response", "status", resp.StatusCode, "message", message)
+	client := chat.Client()
+	chunks := splitMessage(text, maxMessageLength, format)
 
-	var messageResponse TgResponse[TgMessage]
-	if err := json.NewDecoder(resp.Body).Decode(&messageResponse); err != nil {
-		slog.Error("Cannot decode response", "message", message, "error", err)
-		return TgMessage{}, err
+	requests := make([]SendMessageRequest, len(chunks))
+	for i, chunk := range chunks {
+		requests[i] = chat.message(chunk)
+		requests[i].ParseMode = parseMode
+		if i > 0 {
+			requests[i].ReplyParameters = nil
+		}
 	}
 
-	return messageResponse.Result, nil
+	var sent []TgMessage
+	for i, request := range requests {
+		slog.Debug("Sending message", "chunk", i+1, "of", len(chunks), "message", request.Text)
+
+		if coalesced, err := coalesce(chat, client, request); err != nil {
+			return sent, err
+		} else if coalesced {
+			continue
+		}
+
+		message, err := client.SendMessage(context.Background(), request)
+		if err != nil {
+			if opts.Queue && isTransient(err) {
+				if queueErr := enqueue(chat, requests[i:], err); queueErr == nil {
+					return sent, fmt.Errorf("%w: %w", ErrQueued, err)
+				}
+			}
+			slog.Error("Cannot send message", "chunk", i+1, "of", len(chunks), "error", err)
+			return sent, err
+		}
+		sent = append(sent, message)
+	}
+
+	return sent, nil
 }
 
+// Send a ping and wait for a pong, i.e. a reaction on the ping, or a message
+// in the chat after it, from someone other than a bot.
+//
+// Returns `ErrTimeout` if there is no pong in time, or the context error if it is done.
+// With `transient`, the ping and the pong message are deleted afterwards.
 func SendPing(
-	chatId string,
+	ctx context.Context,
+	chat Chat,
 	message string,
 	transient bool,
 	timeout time.Duration,
@@ -85,98 +209,59 @@ func SendPing(
 		message = "Heads up!"
 	}
 
-	origMessage, err := SendMessage(chatId, message)
+	client := chat.Client()
+
+	origMessage, err := client.SendMessage(ctx, chat.message(message))
 	if err != nil {
-		slog.Error("Cannot send ping", "chatID", chatId, "error", err)
+		slog.Error("Cannot send ping", "chatID", chat.Id, "error", err)
 		return err
 	}
 
 	messageId := origMessage.Id
-	updateUrl := getBotURL("getUpdates")
-
-	updateParams := struct { AllowedUpdates []string `json:"allowed_updates"`; Offset int64 `json:"offset"` } {
-		Offset: -1,
-		AllowedUpdates: []string{ "message", "message_reaction" },
-	}
-
-	pollResult := make(chan bool)
-	cleanup := []int64 { messageId }
+	cleanup := []int64{messageId}
 	messageSentTime := time.Unix(origMessage.Date, 0)
 
-	go func() {
-		for {
-			ok := func() bool {
-				jsonUpdateParams, _ := json.Marshal(updateParams)
-				bufUpdateParams := bytes.NewBuffer(jsonUpdateParams)
-				resp, err := http.Post(updateUrl, "application/json", bufUpdateParams)
-				if err != nil {
-					slog.Warn("Failed to poll updates", "error", err)
-					return false
-				}
-				defer resp.Body.Close()
-	
-				var messageResponse TgResponse[[1]map[string]any]
-				json.NewDecoder(resp.Body).Decode(&messageResponse)
-				
-				slog.Debug("Received updates", "response", messageResponse)
-				
-	
-				for _, message := range messageResponse.Result {
-					if message["message_reaction"] != nil {
-						if updateMessageId := message["message_reaction"].(map[string]any)["message_id"]; updateMessageId != nil && int64(updateMessageId.(float64)) == messageId {
-							slog.Debug("Received pong by reaction", "messageId", messageId)
-							return true
-						}
-					} else if message["message"] != nil {
-						updateMessageTime := int64(message["message"].(map[string]any)["date"].(float64))
-						if updateMessageTime > messageSentTime.Unix() {
-							slog.Debug("Received pong by message", "messageId", messageId)
-
-							updateMessageId := int64(message["message"].(map[string]any)["message_id"].(float64))
-							cleanup = append(cleanup, updateMessageId)
-
-							return true
-						}
-					}
-	
-					if updateId := message["update_id"]; updateId != nil {
-						updateParams.Offset = int64(message["update_id"].(float64)) + 1
-					}
-				}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	err = pollUpdates(waitCtx, client, []string{"message", "message_reaction"}, func(update TgUpdate) bool {
+		if reaction := update.MessageReaction; reaction != nil {
+			if reaction.MessageId != messageId || !chat.Matches(reaction.Chat) || (reaction.User != nil && reaction.User.IsBot) {
 				return false
-			}()
-			if ok {
-				pollResult <- true
-				break
 			}
-			slog.Debug("Waiting for message update", "messageId", messageId)
-			time.Sleep(5 * time.Second)
+			slog.Debug("Received pong by reaction", "messageId", messageId)
+			return true
 		}
-	}()
-
-	select {
-	case <-pollResult:
-		now := time.Now()
-		elapsed := now.Sub(messageSentTime)
-		slog.Debug("Received response", "elapsed_min", elapsed.Minutes())
-
-		if transient {
-			cleanupUrl := getBotURL("deleteMessages")
-			cleanupBody, _ := json.Marshal(map[string]interface{}{
-				"chat_id": chatId,
-				"message_ids": cleanup,
-			})
-			cleanupBufBody := bytes.NewBuffer(cleanupBody)
-			if cleanupResp, err := http.Post(cleanupUrl, "application/json", cleanupBufBody); err == nil {
-				cleanupResp.Body.Close()
+
+		if m := update.Message; m != nil {
+			// Message IDs increase within a chat
+			if m.Id <= messageId || !chat.Matches(m.Chat) || m.From == nil || m.From.IsBot {
+				return false
 			}
+			slog.Debug("Received pong by message", "messageId", messageId)
+			cleanup = append(cleanup, m.Id)
+			return true
 		}
 
-		return nil
-	case <-time.After(timeout):
+		return false
+	})
+
+	if err == nil {
+		slog.Debug("Received response", "elapsed_min", time.Since(messageSentTime).Minutes())
+	} else if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
 		slog.Warn("Ping message update timed out", "messageId", messageId)
-		fmt.Fprintf(os.Stderr, "Timeout after %s\n", timeout)
-		os.Exit(1)
-		return nil
+		err = ErrTimeout
 	}
-}
\ No newline at end of file
+
+	if transient {
+		// The context may be done already, clean up regardless
+		if err := client.DeleteMessages(context.WithoutCancel(ctx), DeleteMessagesRequest{
+			ChatId:     chat.Id,
+			MessageIds: cleanup,
+		}); err != nil {
+			slog.Warn("Cannot clean up messages", "error", err)
+		}
+	}
+
+	return err
+}
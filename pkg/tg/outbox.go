@@ -0,0 +1,260 @@
+package tg
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backoff between retries of a queued message, doubling from the base up to the cap.
+const (
+	outboxBackoffBase = 30 * time.Second
+	outboxBackoffCap  = 6 * time.Hour
+)
+
+// A claimed message older than this is considered abandoned by a crashed process.
+const outboxStaleClaim = 10 * time.Minute
+
+// The message cannot be sent now, and is queued in the outbox.
+var ErrQueued = errors.New("message is queued in the outbox")
+
+// A message waiting in the outbox.
+type outboxEntry struct {
+	// Name of the bot in `[tg.bots]`, empty for the default one.
+	Bot         string             `json:"bot,omitempty"`
+	Request     SendMessageRequest `json:"request"`
+	Queued      time.Time          `json:"queued"`
+	Attempts    int                `json:"attempts"`
+	NextAttempt time.Time          `json:"next_attempt"`
+	LastError   string             `json:"last_error,omitempty"`
+}
+
+// The directory of the outbox, under `$XDG_STATE_HOME`, or `~/.local/state`.
+func outboxDir() (string, error) {
+	dir := os.Getenv("XDG_STATE_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		dir = filepath.Join(home, ".local", "state")
+	}
+	return filepath.Join(dir, "tyw", "tg-outbox"), nil
+}
+
+// Whether sending may succeed later, i.e. it failed on the network, flood control, or the server.
+func isTransient(err error) bool {
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) {
+		return apiErr.Code == 429 || apiErr.Code >= 500
+	}
+	return !errors.Is(err, context.Canceled) && !errors.Is(err, errNoToken)
+}
+
+// Whether Telegram refused the message for good, i.e. with a client error other than flood control.
+func isRejected(err error) bool {
+	var apiErr *ApiError
+	return errors.As(err, &apiErr) && apiErr.Code >= 400 && apiErr.Code < 500 && apiErr.Code != 429
+}
+
+// Schedule the next attempt after a failure, honouring `retry_after`.
+func (e *outboxEntry) fail(err error) {
+	e.Attempts++
+	e.LastError = err.Error()
+
+	backoff := outboxBackoffCap
+	if e.Attempts < 16 {
+		backoff = min(outboxBackoffBase<<(e.Attempts-1), outboxBackoffCap)
+	}
+	var apiErr *ApiError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		backoff = max(backoff, time.Duration(apiErr.RetryAfter)*time.Second)
+	}
+	e.NextAttempt = time.Now().Add(backoff)
+}
+
+func writeOutboxEntry(path string, entry outboxEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+
+	// Write aside and rename, so that a flush never reads a partial entry
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Queue messages that failed to be sent, in order.
+//
+// Without a cause, the messages are due right away.
+func enqueue(chat Chat, requests []SendMessageRequest, cause error) error {
+	dir, err := outboxDir()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	for i, request := range requests {
+		entry := outboxEntry{Bot: chat.Bot, Request: request, Queued: now}
+		if cause != nil {
+			entry.fail(cause)
+		}
+
+		// Names sort by the time queued, then the order of chunks
+		name := fmt.Sprintf("%d-%d-%04d.json", now.UnixNano(), os.Getpid(), i)
+		if err := writeOutboxEntry(filepath.Join(dir, name), entry); err != nil {
+			slog.Error("Cannot queue message", "error", err)
+			return err
+		}
+	}
+
+	slog.Warn("Queued messages in outbox", "count", len(requests), "dir", dir, "error", cause)
+	return nil
+}
+
+// The names of the entries in the outbox, oldest first.
+//
+// Entries claimed by a process for long are reclaimed.
+func outboxEntries(dir string) ([]string, error) {
+	dirEntries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, dirEntry := range dirEntries {
+		name := dirEntry.Name()
+		if claimed, ok := strings.CutSuffix(name, ".sending"); ok {
+			if info, err := dirEntry.Info(); err == nil && time.Since(info.ModTime()) > outboxStaleClaim {
+				if os.Rename(filepath.Join(dir, name), filepath.Join(dir, claimed)) == nil {
+					names = append(names, claimed)
+				}
+			}
+			continue
+		}
+		if strings.HasSuffix(name, ".json") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Whether the outbox has messages waiting.
+func OutboxPending() bool {
+	dir, err := outboxDir()
+	if err != nil {
+		return false
+	}
+	names, _ := outboxEntries(dir)
+	return len(names) > 0
+}
+
+// Send the messages in the outbox, oldest first. Returns the number of messages
+// sent, and those left in the outbox.
+//
+// Without `force`, messages whose next attempt is not due yet are skipped.
+// Once a message to a chat fails, later ones to the same chat wait, to keep their order.
+// Messages rejected by Telegram for good, e.g. with a bad request, are dropped.
+// Messages of a bot whose token cannot be read are left as they are.
+func FlushOutbox(ctx context.Context, force bool) (int, int, error) {
+	dir, err := outboxDir()
+	if err != nil {
+		return 0, 0, err
+	}
+	names, err := outboxEntries(dir)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	sent, left := 0, 0
+	blocked := make(map[string]bool)
+	clients := make(map[string]*Client)
+
+	for i, name := range names {
+		if ctx.Err() != nil {
+			// The entries not tried yet are left too
+			return sent, left + len(names) - i, ctx.Err()
+		}
+
+		path := filepath.Join(dir, name)
+		claim := path + ".sending"
+
+		// Claim the entry, another process may be flushing too
+		if err := os.Rename(path, claim); err != nil {
+			continue
+		}
+
+		data, err := os.ReadFile(claim)
+		var entry outboxEntry
+		if err == nil {
+			err = json.Unmarshal(data, &entry)
+		}
+		if err != nil {
+			slog.Warn("Dropping unreadable outbox entry", "name", name, "error", err)
+			os.Remove(claim)
+			continue
+		}
+
+		chatKey := entry.Bot + "\n" + entry.Request.ChatId
+		if blocked[chatKey] || (!force && time.Now().Before(entry.NextAttempt)) {
+			blocked[chatKey] = true
+			os.Rename(claim, path)
+			left++
+			continue
+		}
+
+		client, ok := clients[entry.Bot]
+		if !ok {
+			client = NewClient(entry.Bot)
+			clients[entry.Bot] = client
+		}
+		if client.tokenErr != nil {
+			os.Rename(claim, path)
+			left++
+			continue
+		}
+
+		_, err = client.SendMessage(ctx, entry.Request)
+		switch {
+		case err == nil:
+			slog.Debug("Sent queued message", "name", name, "queued", entry.Queued)
+			os.Remove(claim)
+			sent++
+		case ctx.Err() != nil:
+			os.Rename(claim, path)
+			left++
+		case isRejected(err):
+			slog.Error("Dropping queued message rejected by Telegram", "name", name, "error", err)
+			os.Remove(claim)
+		default:
+			slog.Warn("Cannot send queued message", "name", name, "attempts", entry.Attempts+1, "error", err)
+			entry.fail(err)
+			blocked[chatKey] = true
+			left++
+			if err := writeOutboxEntry(path, entry); err != nil {
+				slog.Error("Cannot update outbox entry", "name", name, "error", err)
+				os.Rename(claim, path)
+				continue
+			}
+			os.Remove(claim)
+		}
+	}
+
+	return sent, left, nil
+}
@@ -0,0 +1,189 @@
+package tg
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+// A stub of the Bot API, answering `sendMessage` to chat `bad` with a bad request,
+// to chat `flood` with flood control, and to others with success.
+func stubBotApi(t *testing.T) *httptest.Server {
+	t.Helper()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request SendMessageRequest
+		json.NewDecoder(r.Body).Decode(&request)
+
+		switch request.ChatId {
+		case "bad":
+			w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`))
+		case "flood":
+			w.Write([]byte(`{"ok":false,"error_code":429,"description":"Too Many Requests","parameters":{"retry_after":120}}`))
+		default:
+			w.Write([]byte(`{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":1}}}`))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// Use the config given for the test, with fresh runtime and state directories.
+func useTgConfig(t *testing.T, config string) {
+	t.Helper()
+
+	t.Setenv("XDG_RUNTIME_DIR", t.TempDir())
+	t.Setenv("XDG_STATE_HOME", t.TempDir())
+
+	v := viper.New()
+	v.SetConfigType("toml")
+	if err := v.ReadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	oldConfig, oldCache := tgConfig, tokenCache
+	tgConfig, tokenCache = v, make(map[string]cachedTokenResult)
+	t.Cleanup(func() { tgConfig, tokenCache = oldConfig, oldCache })
+}
+
+func readOutbox(t *testing.T) []outboxEntry {
+	t.Helper()
+
+	dir, err := outboxDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	names, err := outboxEntries(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []outboxEntry
+	for _, name := range names {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var entry outboxEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestFlushOutboxKeepsMessagesWithoutToken(t *testing.T) {
+	server := stubBotApi(t)
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	if err := os.WriteFile(tokenFile, []byte("123:locked"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	useTgConfig(t, `
+api_url = "`+server.URL+`"
+token = "123:default"
+
+[bots.locked]
+token_file = "`+tokenFile+`"
+`)
+
+	locked := Chat{Id: "1", Bot: "locked"}
+	if err := enqueue(locked, []SendMessageRequest{locked.message("a"), locked.message("b")}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := enqueue(Chat{Id: "1"}, []SendMessageRequest{{ChatId: "1", Text: "c"}}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, left, err := FlushOutbox(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || left != 2 {
+		t.Errorf("sent, left = %d, %d, want 1, 2", sent, left)
+	}
+
+	entries := readOutbox(t)
+	if len(entries) != 2 {
+		t.Fatalf("outbox has %d entries, want 2", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.Bot != "locked" || entry.Attempts != 0 || entry.LastError != "" {
+			t.Errorf("entry %d = %+v, want it untouched", i, entry)
+		}
+	}
+	if entries[0].Request.Text != "a" || entries[1].Request.Text != "b" {
+		t.Errorf("entries are %q, %q, want a, b", entries[0].Request.Text, entries[1].Request.Text)
+	}
+}
+
+func TestFlushOutboxDropsOnlyRejectedMessages(t *testing.T) {
+	server := stubBotApi(t)
+	useTgConfig(t, `
+api_url = "`+server.URL+`"
+token = "123:default"
+`)
+
+	requests := []SendMessageRequest{{ChatId: "bad", Text: "a"}, {ChatId: "1", Text: "b"}, {ChatId: "flood", Text: "c"}}
+	if err := enqueue(Chat{}, requests, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, left, err := FlushOutbox(context.Background(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 1 || left != 1 {
+		t.Errorf("sent, left = %d, %d, want 1, 1", sent, left)
+	}
+
+	entries := readOutbox(t)
+	if len(entries) != 1 || entries[0].Request.ChatId != "flood" || entries[0].Attempts != 1 {
+		t.Errorf("outbox = %+v, want the flood-controlled message with one attempt", entries)
+	}
+}
+
+func TestFlushOutboxCountsLeftWhenCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Reject chat `bad`, and stop the flush while chat `stop` is sent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request SendMessageRequest
+		json.NewDecoder(r.Body).Decode(&request)
+		if request.ChatId == "bad" {
+			w.Write([]byte(`{"ok":false,"error_code":400,"description":"Bad Request: chat not found"}`))
+			return
+		}
+		if request.ChatId == "stop" {
+			cancel()
+		}
+		w.Write([]byte(`{"ok":true,"result":{"message_id":1,"date":0,"chat":{"id":1}}}`))
+	}))
+	defer server.Close()
+	useTgConfig(t, `
+api_url = "`+server.URL+`"
+token = "123:default"
+`)
+
+	requests := []SendMessageRequest{{ChatId: "bad", Text: "a"}, {ChatId: "stop", Text: "b"}, {ChatId: "1", Text: "c"}, {ChatId: "1", Text: "d"}}
+	if err := enqueue(Chat{}, requests, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	sent, left, err := FlushOutbox(ctx, true)
+	if err == nil {
+		t.Error("FlushOutbox is not cancelled")
+	}
+	// The rejected message is dropped, and the others are kept
+	if entries := readOutbox(t); sent != 0 || left != 3 || len(entries) != 3 {
+		t.Errorf("sent, left = %d, %d with %d in the outbox, want 0, 3", sent, left, len(entries))
+	}
+}
@@ -0,0 +1,69 @@
+package tg
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// Seconds the Bot API server holds a `getUpdates` request when there is no update.
+const pollTimeout = 30
+
+// Delay before polling again after a failure.
+const pollRetryDelay = 5 * time.Second
+
+// No response is received before the timeout.
+var ErrTimeout = errors.New("timed out waiting for a response")
+
+// Receive updates of the allowed types until `handle` returns true,
+// or the context is done.
+//
+// Updates come from the daemon if it is running, otherwise they are polled directly.
+func pollUpdates(ctx context.Context, client *Client, allowed []string, handle func(TgUpdate) bool) error {
+	if conn, err := dialDaemon(ctx, client, allowed); err == nil {
+		slog.Debug("Receiving updates from daemon")
+		err := receiveFromDaemon(ctx, conn, handle)
+		if !errors.Is(err, errDaemonGone) {
+			return err
+		}
+		slog.Warn("Lost daemon, polling updates directly")
+	}
+
+	return pollUpdatesDirectly(ctx, client, allowed, handle)
+}
+
+// Long poll updates of the allowed types until `handle` returns true,
+// or the context is done.
+//
+// Failed polls are retried, as connectivity on remote boxes is often flaky.
+func pollUpdatesDirectly(ctx context.Context, client *Client, allowed []string, handle func(TgUpdate) bool) error {
+	request := GetUpdatesRequest{
+		Timeout:        pollTimeout,
+		AllowedUpdates: allowed,
+	}
+
+	for {
+		updates, err := client.GetUpdates(ctx, request)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Warn("Failed to poll updates", "error", err)
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(pollRetryDelay):
+			}
+			continue
+		}
+
+		slog.Debug("Received updates", "count", len(updates))
+		for _, update := range updates {
+			request.Offset = update.Id + 1
+			if handle(update) {
+				return nil
+			}
+		}
+	}
+}
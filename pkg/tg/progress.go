@@ -0,0 +1,164 @@
+package tg
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Width of the text progress bar in characters.
+const progressBarWidth = 20
+
+var regexProgress = regexp.MustCompile(`(\d+)\s*/\s*(\d+)`)
+
+// Render a text progress bar if the line looks like `n/total`.
+func progressBar(line string) (string, bool) {
+	matches := regexProgress.FindStringSubmatch(line)
+	if matches == nil {
+		return "", false
+	}
+
+	done, err1 := strconv.Atoi(matches[1])
+	total, err2 := strconv.Atoi(matches[2])
+	if err1 != nil || err2 != nil || total <= 0 {
+		return "", false
+	}
+	done = min(done, total)
+
+	filled := done * progressBarWidth / total
+	bar := strings.Repeat("█", filled) + strings.Repeat("░", progressBarWidth-filled)
+	return fmt.Sprintf("%s %d%% (%d/%d)", bar, done*100/total, done, total), true
+}
+
+// Options of `Progress`.
+type ProgressOptions struct {
+	// The first line of the message, kept across updates.
+	Title string
+	// The minimum interval between edits.
+	Interval time.Duration
+	// Show a progress bar for lines like `n/total`.
+	Bar bool
+}
+
+// Format the progress message from the latest line.
+func (opts ProgressOptions) format(line string) string {
+	var parts []string
+	if opts.Title != "" {
+		parts = append(parts, opts.Title)
+	}
+	if opts.Bar {
+		if bar, ok := progressBar(line); ok {
+			parts = append(parts, bar)
+		}
+	}
+	if line != "" {
+		parts = append(parts, line)
+	}
+	if len(parts) == 0 {
+		return "…"
+	}
+
+	text := strings.Join(parts, "\n")
+	if runes := []rune(text); len(runes) > maxMessageLength {
+		text = string(runes[:maxMessageLength])
+	}
+	return text
+}
+
+// Send one message, then keep editing it to show the latest line read from the input.
+//
+// Edits are at least `Interval` apart, and the last line is always shown when the input ends.
+func Progress(ctx context.Context, chat Chat, input io.Reader, opts ProgressOptions) error {
+	client := chat.Client()
+
+	shown := opts.format("")
+	message, err := client.SendMessage(ctx, chat.message(shown))
+	if err != nil {
+		slog.Error("Cannot send progress message", "chatId", chat.Id, "error", err)
+		return err
+	}
+	slog.Debug("Sent progress message", "messageId", message.Id)
+
+	lines := make(chan string)
+	readErr := make(chan error, 1)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(input)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			select {
+			case lines <- scanner.Text():
+			case <-ctx.Done():
+				return
+			}
+		}
+		readErr <- scanner.Err()
+	}()
+
+	latest := ""
+	nextEdit := time.Now()
+
+	edit := func() {
+		text := opts.format(latest)
+		if text == shown {
+			return
+		}
+
+		_, err := client.EditMessageText(ctx, EditMessageTextRequest{
+			ChatId:    chat.Id,
+			MessageId: message.Id,
+			Text:      text,
+		})
+
+		var apiErr *ApiError
+		switch {
+		case err == nil:
+			shown = text
+			nextEdit = time.Now().Add(opts.Interval)
+		case errors.As(err, &apiErr) && apiErr.RetryAfter > 0:
+			slog.Warn("Editing progress message too fast", "retryAfter", apiErr.RetryAfter)
+			nextEdit = time.Now().Add(time.Duration(apiErr.RetryAfter) * time.Second)
+		default:
+			slog.Warn("Cannot edit progress message", "error", err)
+			nextEdit = time.Now().Add(opts.Interval)
+		}
+	}
+
+	ticker := time.NewTicker(max(opts.Interval/4, 100*time.Millisecond))
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case line, ok := <-lines:
+			if !ok {
+				// Always show the last line, waiting out the interval
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-time.After(time.Until(nextEdit)):
+				}
+				edit()
+				select {
+				case err := <-readErr:
+					return err
+				default:
+					return nil
+				}
+			}
+			latest = line
+		case <-ticker.C:
+			if !time.Now().Before(nextEdit) {
+				edit()
+			}
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package tg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Write the content of a file got by `GetFile` to the writer.
+//
+// A local Bot API server gives an absolute path, which is read directly.
+func (c *Client) DownloadFile(ctx context.Context, file TgFile, w io.Writer) error {
+	if c.tokenErr != nil {
+		return c.tokenErr
+	}
+
+	if filepath.IsAbs(file.FilePath) {
+		local, err := os.Open(file.FilePath)
+		if err != nil {
+			return err
+		}
+		defer local.Close()
+		_, err = io.Copy(w, local)
+		return err
+	}
+
+	fileUrl := strings.TrimSuffix(c.ApiUrl, "/") + "/file/bot" + c.Token + "/" + file.FilePath
+	slog.Debug("Downloading file", "fileId", file.FileId, "path", file.FilePath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileUrl, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.Http.Do(req)
+	if err != nil {
+		return c.redactError(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cannot download file %s: %s", file.FilePath, resp.Status)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// The file attached to a message and its name, for a document or a photo.
+func attachedFile(m *TgMessage) (string, string, bool) {
+	switch {
+	case m.Document != nil:
+		name := m.Document.FileName
+		if name == "" {
+			name = "document_" + m.Document.FileUniqueId
+		}
+		return m.Document.FileId, name, true
+	case len(m.Photo) > 0:
+		largest := m.Photo[len(m.Photo)-1]
+		return largest.FileId, "photo_" + largest.FileUniqueId + ".jpg", true
+	}
+	return "", "", false
+}
+
+// Create a file in the directory by the name, adding a number before the extension
+// if the name is taken, e.g. `config-1.toml`.
+func createUnique(dir string, name string) (*os.File, error) {
+	// The name comes from the sender, never write outside the directory
+	name = filepath.Base(filepath.Clean("/" + name))
+	if name == "/" || name == "." {
+		name = "file"
+	}
+
+	ext := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, ext)
+	for i := 0; ; i++ {
+		candidate := name
+		if i > 0 {
+			candidate = fmt.Sprintf("%s-%d%s", stem, i, ext)
+		}
+		file, err := os.OpenFile(filepath.Join(dir, candidate), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if !errors.Is(err, os.ErrExist) {
+			return file, err
+		}
+	}
+}
+
+// Wait for the next document or photo sent to the chat by someone other than a bot,
+// and download it into the directory by its original name. Returns the path written.
+//
+// Returns `ErrTimeout` if nothing is sent in time, or the context error if it is done.
+func Receive(ctx context.Context, chat Chat, dir string, timeout time.Duration) (string, error) {
+	if stat, err := os.Stat(dir); err != nil {
+		return "", err
+	} else if !stat.IsDir() {
+		return "", fmt.Errorf("%s is not a directory", dir)
+	}
+
+	client := chat.Client()
+	startTime := time.Now().Unix()
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var fileId, name string
+	err := pollUpdates(waitCtx, client, []string{"message"}, func(update TgUpdate) bool {
+		m := update.Message
+		// Skip files sent before waiting
+		if m == nil || !chat.Matches(m.Chat) || m.From == nil || m.From.IsBot || m.Date < startTime {
+			return false
+		}
+		var ok bool
+		fileId, name, ok = attachedFile(m)
+		return ok
+	})
+	if errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil {
+		slog.Warn("No file is received", "timeout", timeout)
+		return "", ErrTimeout
+	} else if err != nil {
+		return "", err
+	}
+
+	slog.Info("Received file", "name", name, "fileId", fileId)
+
+	file, err := client.GetFile(ctx, GetFileRequest{FileId: fileId})
+	if err != nil {
+		slog.Error("Cannot get file", "name", name, "error", err)
+		return "", err
+	}
+
+	out, err := createUnique(dir, name)
+	if err != nil {
+		return "", err
+	}
+	if err := client.DownloadFile(ctx, file, out); err != nil {
+		out.Close()
+		os.Remove(out.Name())
+		slog.Error("Cannot download file", "name", name, "error", err)
+		return "", err
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+
+	return filepath.Abs(out.Name())
+}
@@ -0,0 +1,208 @@
+package tg
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// When to notify after a command finishes.
+const (
+	NotifyAlways  = "always"
+	NotifySuccess = "success"
+	NotifyFailure = "failure"
+)
+
+// Telegram rejects longer messages.
+const maxMessageLength = 4096
+
+// A writer keeping the last lines written to it.
+type tailBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	partial bytes.Buffer
+	max     int
+}
+
+func (t *tailBuffer) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, b := range p {
+		if b == '\n' {
+			t.push(t.partial.String())
+			t.partial.Reset()
+		} else {
+			t.partial.WriteByte(b)
+		}
+	}
+	return len(p), nil
+}
+
+func (t *tailBuffer) push(line string) {
+	if t.max <= 0 {
+		return
+	}
+	t.lines = append(t.lines, strings.TrimRight(line, "\r"))
+	if len(t.lines) > t.max {
+		t.lines = t.lines[len(t.lines)-t.max:]
+	}
+}
+
+// The last lines, including an unterminated one.
+func (t *tailBuffer) Lines() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	lines := append([]string{}, t.lines...)
+	if t.partial.Len() > 0 && t.max > 0 {
+		lines = append(lines, t.partial.String())
+		if len(lines) > t.max {
+			lines = lines[1:]
+		}
+	}
+	return lines
+}
+
+// The outcome of a command run by `RunCommand`.
+type RunResult struct {
+	Args     []string
+	Host     string
+	ExitCode int
+	Elapsed  time.Duration
+	Tail     []string
+	// Set when the command cannot be started.
+	Err error
+}
+
+// Run a command with stdio passed through, keeping the last lines of its output.
+//
+// Signals do not terminate this process, so that the result can still be reported.
+// Interrupts already reach the command from the terminal, other signals are forwarded.
+func RunCommand(args []string, tailLines int) RunResult {
+	host, _ := os.Hostname()
+	result := RunResult{Args: args, Host: host}
+
+	tail := &tailBuffer{max: tailLines}
+
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = io.MultiWriter(os.Stdout, tail)
+	cmd.Stderr = io.MultiWriter(os.Stderr, tail)
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+
+	start := time.Now()
+	if err := cmd.Start(); err != nil {
+		slog.Error("Cannot start command", "args", args, "error", err)
+		result.Err = err
+		result.ExitCode = 127
+		return result
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	var err error
+wait:
+	for {
+		select {
+		case sig := <-signals:
+			if sig != os.Interrupt {
+				slog.Debug("Forwarding signal", "signal", sig)
+				cmd.Process.Signal(sig)
+			}
+		case err = <-done:
+			break wait
+		}
+	}
+
+	result.Elapsed = time.Since(start)
+	result.Tail = tail.Lines()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		result.ExitCode = 0
+	case errors.As(err, &exitErr):
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			result.ExitCode = 128 + int(status.Signal())
+		} else {
+			result.ExitCode = exitErr.ExitCode()
+		}
+	default:
+		result.Err = err
+		result.ExitCode = 1
+	}
+
+	return result
+}
+
+// Whether the result should be notified given the `--on` condition.
+func (r RunResult) ShouldNotify(on string) bool {
+	switch on {
+	case NotifySuccess:
+		return r.ExitCode == 0
+	case NotifyFailure:
+		return r.ExitCode != 0
+	default:
+		return true
+	}
+}
+
+// Format the result as a message, trimming the output to fit in one message.
+func (r RunResult) Message() string {
+	var header strings.Builder
+
+	status := "✅ Finished"
+	if r.ExitCode != 0 {
+		status = "❌ Failed"
+	}
+	fmt.Fprintf(&header, "%s: %s\n", status, shellJoin(r.Args))
+	fmt.Fprintf(&header, "Host: %s\n", r.Host)
+	if r.Err != nil {
+		fmt.Fprintf(&header, "Error: %s\n", r.Err)
+	}
+	fmt.Fprintf(&header, "Exit: %d\n", r.ExitCode)
+	fmt.Fprintf(&header, "Time: %s\n", r.Elapsed.Round(time.Second))
+
+	message := header.String()
+	if len(r.Tail) == 0 {
+		return strings.TrimRight(message, "\n")
+	}
+
+	// Keep the latest output when it does not fit
+	tail := r.Tail
+	for len(tail) > 0 {
+		body := "\n" + strings.Join(tail, "\n")
+		if len(message)+len(body) <= maxMessageLength {
+			return message + body
+		}
+		tail = tail[1:]
+	}
+	return strings.TrimRight(message, "\n")
+}
+
+// Join arguments into a command line, quoting those that need it.
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\$`|&;<>()*?[]{}~#!") {
+			quoted[i] = "'" + strings.ReplaceAll(arg, "'", `'\''`) + "'"
+		} else {
+			quoted[i] = arg
+		}
+	}
+	return strings.Join(quoted, " ")
+}
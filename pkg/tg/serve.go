@@ -0,0 +1,184 @@
+package tg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os/exec"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Options of `Serve`.
+type ServeOptions struct {
+	// Shell commands by their names, without the leading slash.
+	Commands map[string]string
+	// IDs of users allowed to run commands.
+	AllowedUsers []string
+	// How long a command may run before it is killed.
+	Timeout time.Duration
+}
+
+// Read the commands from `[tg.commands]` and the allowlist from `allowed_users`.
+//
+// Command names may be given with or without the leading slash.
+func GetServeOptions() ServeOptions {
+	commands := make(map[string]string)
+	for name, command := range tgConfig.GetStringMapString("commands") {
+		commands[strings.TrimPrefix(name, "/")] = command
+	}
+
+	return ServeOptions{
+		Commands:     commands,
+		AllowedUsers: tgConfig.GetStringSlice("allowed_users"),
+	}
+}
+
+// Parse a bot command like `/status@my_bot args`, returning its name.
+//
+// Commands addressed to other bots than the one with the username are not parsed.
+func parseCommand(text string, username string) (string, bool) {
+	if !strings.HasPrefix(text, "/") {
+		return "", false
+	}
+	name, to, addressed := strings.Cut(strings.Fields(text)[0], "@")
+	if addressed && !strings.EqualFold(to, username) {
+		return "", false
+	}
+	return strings.TrimPrefix(name, "/"), true
+}
+
+// Run a whitelisted command through the shell, returning the reply.
+func (opts ServeOptions) run(ctx context.Context, name string, command string) string {
+	ctx, cancel := context.WithTimeout(ctx, opts.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	// Kill the whole process group, so children holding the output do not outlive the timeout
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error { return syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) }
+	cmd.WaitDelay = time.Second
+
+	start := time.Now()
+	output, err := cmd.CombinedOutput()
+	elapsed := time.Since(start).Round(time.Millisecond)
+
+	status := "exit 0"
+	var exitErr *exec.ExitError
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		status = fmt.Sprintf("killed after %s", opts.Timeout)
+	case errors.As(err, &exitErr):
+		status = fmt.Sprintf("exit %d", exitErr.ExitCode())
+	case err != nil:
+		status = err.Error()
+	}
+	slog.Info("Ran command", "name", name, "status", status, "elapsed", elapsed)
+
+	header := fmt.Sprintf("/%s (%s, %s)", name, status, elapsed)
+	text := strings.TrimRight(string(output), "\n")
+	if text == "" {
+		return EscapeHtml(header)
+	}
+
+	// Keep the end of the output, which usually matters most
+	runes := []rune(text)
+	for {
+		reply := EscapeHtml(header) + "\n" + CodeBlock(string(runes), ParseModeHtml)
+		if len([]rune(reply)) <= maxMessageLength {
+			return reply
+		}
+		runes = runes[max(1, len(runes)/8):]
+	}
+}
+
+// The reply to `/help`, listing the commands.
+func (opts ServeOptions) help() string {
+	names := make([]string, 0, len(opts.Commands))
+	for name := range opts.Commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("Commands:")
+	for _, name := range names {
+		fmt.Fprintf(&b, "\n/%s: <code>%s</code>", name, EscapeHtml(opts.Commands[name]))
+	}
+	return b.String()
+}
+
+// Serve whitelisted commands to allowed users in the chat, until the context is done.
+//
+// Messages from other chats are ignored, and commands from users not allowed are rejected.
+// Commands run one at a time, through the shell, and do not take arguments.
+func Serve(ctx context.Context, chat Chat, opts ServeOptions) error {
+	if len(opts.AllowedUsers) == 0 {
+		return errors.New("no allowed_users found in config, refusing to serve")
+	}
+	if len(opts.Commands) == 0 {
+		return errors.New("no [tg.commands] found in config")
+	}
+
+	client := chat.Client()
+	reply := func(text string) {
+		request := chat.message(text)
+		request.ParseMode = ParseModeHtml
+		if _, err := client.SendMessage(ctx, request); err != nil {
+			slog.Warn("Cannot reply", "error", err)
+		}
+	}
+
+	slog.Info("Serving commands", "chatId", chat.Id, "commands", len(opts.Commands))
+	// Groups may have other bots, whose commands are left to them
+	bot, err := client.GetMe(ctx)
+	if err != nil {
+		slog.Error("Cannot get bot", "error", err)
+		return err
+	}
+
+	startTime := time.Now().Unix()
+
+	err = pollUpdates(ctx, client, []string{"message"}, func(update TgUpdate) bool {
+		m := update.Message
+		// Skip messages from other chats, and old ones left before serving
+		if m == nil || !chat.Matches(m.Chat) || m.Date < startTime {
+			return false
+		}
+
+		name, ok := parseCommand(m.Text, bot.Username)
+		if !ok {
+			return false
+		}
+
+		if m.From == nil || !slices.Contains(opts.AllowedUsers, strconv.FormatInt(m.From.Id, 10)) {
+			slog.Warn("Rejected command from user not allowed", "name", name, "from", m.From)
+			reply("You are not allowed to run commands.")
+			return false
+		}
+
+		if name == "help" || name == "start" {
+			reply(opts.help())
+			return false
+		}
+
+		command, ok := opts.Commands[name]
+		if !ok {
+			reply(fmt.Sprintf("Unknown command /%s, see /help.", EscapeHtml(name)))
+			return false
+		}
+
+		reply(opts.run(ctx, name, command))
+		return false
+	})
+
+	if errors.Is(err, context.Canceled) {
+		return nil
+	}
+	return err
+}
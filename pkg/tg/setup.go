@@ -0,0 +1,189 @@
+package tg
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/yixuan-wang/tyw/pkg/util"
+)
+
+// A human-readable name of a chat.
+func (chat TgChat) DisplayName() string {
+	switch {
+	case chat.Title != "":
+		return chat.Title
+	case chat.FirstName != "" || chat.LastName != "":
+		return strings.TrimSpace(chat.FirstName + " " + chat.LastName)
+	case chat.Username != "":
+		return "@" + chat.Username
+	}
+	return strconv.FormatInt(chat.Id, 10)
+}
+
+// Wait for messages to the bot, returning the chats seen in order.
+//
+// Returns a little while after any chat is seen, to collect more chats
+// messaging at about the same time, or when the context is done.
+func discoverChats(ctx context.Context, client *Client) ([]TgChat, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	seen := make(map[int64]bool)
+	var chats []TgChat
+	err := pollUpdates(ctx, client, []string{"message", "channel_post", "my_chat_member"}, func(update TgUpdate) bool {
+		var chat *TgChat
+		switch {
+		case update.Message != nil:
+			chat = &update.Message.Chat
+		case update.ChannelPost != nil:
+			chat = &update.ChannelPost.Chat
+		case update.MyChatMember != nil:
+			chat = &update.MyChatMember.Chat
+		}
+
+		if chat != nil && !seen[chat.Id] {
+			if len(chats) == 0 {
+				time.AfterFunc(discoverGrace, cancel)
+			}
+			seen[chat.Id] = true
+			chats = append(chats, *chat)
+		}
+		return false
+	})
+
+	if len(chats) > 0 {
+		return chats, nil
+	}
+	return nil, err
+}
+
+// How long to keep collecting chats after the first one is seen.
+const discoverGrace = 3 * time.Second
+
+// Write values under `[tg]` into the config file viper loaded,
+// or `tyw.toml` in the user config directory if none is loaded.
+//
+// A new file is only readable by the user, as it may hold the token.
+// An existing file readable by others is restricted before a token is written to it.
+func writeConfig(values map[string]string) (string, error) {
+	for key, value := range values {
+		viper.Set("tg."+key, value)
+	}
+
+	path := viper.ConfigFileUsed()
+	if path == "" {
+		configDir, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		if err := os.MkdirAll(configDir, 0o755); err != nil {
+			return "", err
+		}
+		path = filepath.Join(configDir, "tyw.toml")
+	}
+
+	if info, err := os.Stat(path); err == nil && info.Mode().Perm()&0o004 != 0 {
+		if _, ok := values["token"]; ok {
+			if err := os.Chmod(path, info.Mode().Perm()&^0o077); err != nil {
+				return "", err
+			}
+			fmt.Fprintf(os.Stderr, "Config %s was readable by others, so it is made private before saving the token.\n", path)
+		} else {
+			fmt.Fprintf(os.Stderr, "Warning: config %s is readable by others, restrict it with chmod 600 if it holds a token.\n", path)
+		}
+	}
+
+	viper.SetConfigPermissions(0o600)
+	if err := viper.WriteConfigAs(path); err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+// Set up the bot token and chat ID interactively.
+//
+// The token is validated with `getMe`, then the user is asked to message the bot,
+// and one of the chats seen is picked. The chat is saved as the top-level `chat_id`,
+// or as `[tg.chats.<name>]` if a name is given.
+func Setup(token string, name string, timeout time.Duration) error {
+	client := NewClient("")
+	if token != "" {
+		client.Token, client.tokenErr = token, nil
+	}
+	if client.tokenErr != nil {
+		return util.Fail("No token is given or read from config", "error", client.tokenErr)
+	}
+
+	ctx := context.Background()
+
+	bot, err := client.GetMe(ctx)
+	if err != nil {
+		return util.Fail("Token is invalid", "error", err)
+	}
+	fmt.Fprintf(os.Stderr, "Bot @%s is found. Send it a message, or add it to a group or channel, within %s.\n", bot.Username, timeout)
+
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	chats, err := discoverChats(waitCtx, client)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return util.Fail("No message to the bot is received", "timeout", timeout)
+	} else if err != nil {
+		return util.Fail("Failed to get updates", "error", err)
+	}
+
+	choices := make(chan TgChat)
+	go func() {
+		defer close(choices)
+		for _, chat := range chats {
+			choices <- chat
+		}
+	}()
+
+	chat, err := util.FzfGetFromChan(ctx, choices, func(chat TgChat) (util.FzfLine[TgChat], error) {
+		username := ""
+		if chat.Username != "" {
+			username = "@" + chat.Username
+		}
+		return util.FzfLine[TgChat]{
+			Key:    strconv.FormatInt(chat.Id, 10),
+			Pretty: []string{chat.DisplayName(), chat.Type, username},
+			Raw:    chat,
+		}, nil
+	}, util.FzfOptions{Header: []string{"Pick the chat to send to"}, Align: true})
+	if err != nil {
+		return util.Fail("No chat is picked", "error", err)
+	}
+
+	chatId := strconv.FormatInt(chat.Id, 10)
+	// Keep a token from token_file or token_cmd out of the config
+	values := map[string]string{}
+	if token != "" {
+		values["token"] = token
+	}
+	if name != "" {
+		values["chats."+name+".chat_id"] = chatId
+	} else {
+		values["chat_id"] = chatId
+	}
+
+	path, err := writeConfig(values)
+	if err != nil {
+		return util.Fail("Failed to write config", "error", err)
+	}
+	slog.Info("Config is written", "file", path)
+	fmt.Fprintf(os.Stderr, "Chat %s (%s) is saved to %s.\n", chat.DisplayName(), chatId, path)
+
+	if _, err := client.SendMessage(ctx, SendMessageRequest{ChatId: chatId, Text: "tyw is set up for this chat."}); err != nil {
+		slog.Warn("Cannot send confirmation", "error", err)
+	}
+	return nil
+}
@@ -0,0 +1,63 @@
+package tg
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Variables available to every template, overridden by those given explicitly.
+//
+// `hostname`, `user`, `cwd`, `time`, `git_branch` of the working directory,
+// and `venv`, the active `VIRTUAL_ENV`. Those not obtainable are empty.
+func templateBuiltins() map[string]string {
+	vars := map[string]string{
+		"time": time.Now().Format(time.DateTime),
+		"venv": os.Getenv("VIRTUAL_ENV"),
+	}
+
+	vars["hostname"], _ = os.Hostname()
+	vars["cwd"], _ = os.Getwd()
+	if u, err := user.Current(); err == nil {
+		vars["user"] = u.Username
+	} else {
+		vars["user"] = os.Getenv("USER")
+	}
+	if out, err := exec.Command("git", "rev-parse", "--abbrev-ref", "HEAD").Output(); err == nil {
+		vars["git_branch"] = strings.TrimSpace(string(out))
+	} else {
+		vars["git_branch"] = ""
+	}
+
+	return vars
+}
+
+// Render a template in `[tg.templates]` with the variables, besides the builtin ones.
+//
+// Variables are referred to like `{{.job}}`, and referring to an unknown one is an error.
+func RenderTemplate(name string, vars map[string]string) (string, error) {
+	text := tgConfig.GetString("templates." + name)
+	if text == "" {
+		return "", fmt.Errorf("no template %s found in [tg.templates]", name)
+	}
+
+	tmpl, err := template.New(name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("cannot parse template %s: %w", name, err)
+	}
+
+	data := templateBuiltins()
+	for key, value := range vars {
+		data[key] = value
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("cannot render template %s: %w", name, err)
+	}
+	return b.String(), nil
+}
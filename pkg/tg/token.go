@@ -0,0 +1,110 @@
+package tg
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/spf13/viper"
+)
+
+// The token of a bot cannot be read from config.
+var errNoToken = errors.New("cannot read token")
+
+// Tokens read by bot name, or why they cannot be read, so that `token_cmd` runs once per process.
+var (
+	tokenMu    sync.Mutex
+	tokenCache = make(map[string]cachedTokenResult)
+)
+
+type cachedTokenResult struct {
+	token string
+	err   error
+}
+
+func cachedToken(bot string, v *viper.Viper) (string, error) {
+	tokenMu.Lock()
+	defer tokenMu.Unlock()
+
+	result, ok := tokenCache[bot]
+	if !ok {
+		result.token, result.err = readToken(v)
+		if result.err != nil {
+			result.err = fmt.Errorf("%w: %w", errNoToken, result.err)
+		}
+		tokenCache[bot] = result
+	}
+	return result.token, result.err
+}
+
+// Read the token of a bot from its config, in the order of
+// `token` (or `TELEGRAM_TOKEN` for the default bot), `token_file`, and `token_cmd`.
+func readToken(v *viper.Viper) (string, error) {
+	if token := v.GetString("token"); token != "" {
+		return token, nil
+	}
+	if path := v.GetString("token_file"); path != "" {
+		return readTokenFile(path)
+	}
+	if command := v.GetString("token_cmd"); command != "" {
+		return runTokenCmd(command)
+	}
+	return "", errors.New("no token, token_file or token_cmd found in config")
+}
+
+// Read a token from a file, refusing one readable by others.
+func readTokenFile(path string) (string, error) {
+	if rest, ok := strings.CutPrefix(path, "~/"); ok {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(home, rest)
+	}
+
+	stat, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if stat.Mode().Perm()&0o004 != 0 {
+		return "", fmt.Errorf("token_file %s is readable by others, restrict it with chmod 600", path)
+	}
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(content))
+	if token == "" {
+		return "", fmt.Errorf("token_file %s is empty", path)
+	}
+	return token, nil
+}
+
+// Run a command such as `pass show tg` through the shell, using its first line of output as the token.
+//
+// It can prompt for a passphrase on the terminal, but never reads stdin,
+// which may hold the input of commands like `progress`.
+func runTokenCmd(command string) (string, error) {
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	if tty, err := os.Open("/dev/tty"); err == nil {
+		defer tty.Close()
+		cmd.Stdin = tty
+	}
+
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("token_cmd failed: %w", err)
+	}
+
+	token, _, _ := strings.Cut(strings.TrimSpace(string(output)), "\n")
+	if token = strings.TrimSpace(token); token == "" {
+		return "", errors.New("token_cmd printed nothing")
+	}
+	return token, nil
+}
@@ -0,0 +1,253 @@
+package tg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Interval of checking whether a process has exited.
+//
+// The exit status is only readable between the exit and the parent reaping it, so check often.
+const waitPollInterval = 200 * time.Millisecond
+
+// Longer command lines are cut in messages, leaving room for the rest.
+const maxCmdlineLength = 3000
+
+// Clock ticks per second used in `/proc`, which is 100 on all common Linux platforms.
+const procClockTicks = 100
+
+// A process read from `/proc`.
+type ProcessInfo struct {
+	Pid     int
+	Ppid    int
+	Cmdline string
+	// One of `R`, `S`, `D`, `Z` etc. as in `ps`.
+	State byte
+	// Clock ticks since boot, telling the process from a later one reusing its PID.
+	StartTicks uint64
+	// The status as reported by `waitpid`, only meaningful for a zombie.
+	ExitStatus int
+}
+
+// Read a process from `/proc/<pid>`.
+func readProc(pid int) (ProcessInfo, error) {
+	dir := filepath.Join("/proc", strconv.Itoa(pid))
+
+	stat, err := os.ReadFile(filepath.Join(dir, "stat"))
+	if err != nil {
+		return ProcessInfo{}, err
+	}
+
+	// The command name may contain spaces and parentheses, fields follow the last `)`
+	end := bytes.LastIndexByte(stat, ')')
+	if end < 0 {
+		return ProcessInfo{}, fmt.Errorf("malformed %s/stat", dir)
+	}
+	fields := strings.Fields(string(stat[end+1:]))
+	if len(fields) < 20 {
+		return ProcessInfo{}, fmt.Errorf("malformed %s/stat", dir)
+	}
+
+	info := ProcessInfo{Pid: pid, State: fields[0][0]}
+	info.Ppid, _ = strconv.Atoi(fields[1])
+	info.StartTicks, _ = strconv.ParseUint(fields[19], 10, 64)
+	// Available since Linux 3.5
+	if len(fields) >= 50 {
+		info.ExitStatus, _ = strconv.Atoi(fields[49])
+	}
+
+	// Kernel threads and zombies have no command line
+	cmdline, _ := os.ReadFile(filepath.Join(dir, "cmdline"))
+	info.Cmdline = strings.TrimSpace(strings.ReplaceAll(string(cmdline), "\x00", " "))
+	if info.Cmdline == "" {
+		name := string(stat[bytes.IndexByte(stat, '(')+1 : end])
+		info.Cmdline = "[" + name + "]"
+	}
+
+	return info, nil
+}
+
+// Whether the exit status of a process is readable by this one, i.e. we are root,
+// or own the process without it changing its user.
+//
+// Otherwise the kernel reports the status as 0, whatever it is.
+func exitStatusReadable(pid int) bool {
+	uid := os.Geteuid()
+	if uid == 0 {
+		return true
+	}
+
+	status, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "status"))
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(status), "\n") {
+		if rest, ok := strings.CutPrefix(line, "Uid:"); ok {
+			// The real, effective, saved and filesystem UIDs
+			uids := strings.Fields(rest)
+			if len(uids) < 3 {
+				return false
+			}
+			for _, field := range uids[:3] {
+				if field != strconv.Itoa(uid) {
+					return false
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// The time a process started, given its start time in clock ticks since boot.
+func processStartTime(startTicks uint64) (time.Time, error) {
+	uptime, err := os.ReadFile("/proc/uptime")
+	if err != nil {
+		return time.Time{}, err
+	}
+	fields := strings.Fields(string(uptime))
+	if len(fields) == 0 {
+		return time.Time{}, errors.New("malformed /proc/uptime")
+	}
+	seconds, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	// Uptime is more precise than the boot time in /proc/stat, given in whole seconds
+	sinceStart := time.Duration(seconds*float64(time.Second)) - time.Duration(startTicks)*time.Second/procClockTicks
+	return time.Now().Add(-sinceStart), nil
+}
+
+// Find the processes whose command line matches the pattern, like `pgrep -f`.
+//
+// This process and its ancestors are left out, since their command lines
+// usually contain the pattern itself.
+func FindProcesses(pattern *regexp.Regexp) ([]ProcessInfo, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	excluded := make(map[int]bool)
+	for pid := os.Getpid(); pid > 1 && !excluded[pid]; {
+		excluded[pid] = true
+		info, err := readProc(pid)
+		if err != nil {
+			break
+		}
+		pid = info.Ppid
+	}
+
+	var found []ProcessInfo
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || excluded[pid] {
+			continue
+		}
+		info, err := readProc(pid)
+		if err != nil || info.State == 'Z' {
+			continue
+		}
+		if pattern.MatchString(info.Cmdline) {
+			found = append(found, info)
+		}
+	}
+	return found, nil
+}
+
+// The outcome of a process waited for by `WaitProcess`.
+type WaitResult struct {
+	Pid     int
+	Cmdline string
+	Host    string
+	// The time since the process started.
+	Elapsed time.Duration
+	// The exit code, or 128 plus the signal, valid only if `StatusKnown`.
+	ExitCode    int
+	StatusKnown bool
+}
+
+// Wait for a process not started by this one to exit.
+//
+// Its exit status is known only if it is caught as a zombie before its parent reaps it,
+// since Linux only reports the status to the parent, and if it is readable by this process.
+func WaitProcess(ctx context.Context, pid int) (WaitResult, error) {
+	info, err := readProc(pid)
+	if err != nil {
+		return WaitResult{}, fmt.Errorf("no process %d: %w", pid, err)
+	}
+
+	host, _ := os.Hostname()
+	result := WaitResult{Pid: pid, Cmdline: info.Cmdline, Host: host}
+	readable := exitStatusReadable(pid)
+
+	started, err := processStartTime(info.StartTicks)
+	if err != nil {
+		started = time.Now()
+	}
+
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+
+	for {
+		current, err := readProc(pid)
+		switch {
+		case err != nil || current.StartTicks != info.StartTicks:
+			// Reaped already, or the PID is reused
+			result.Elapsed = time.Since(started)
+			return result, nil
+		case current.State == 'Z' || current.State == 'X':
+			result.Elapsed = time.Since(started)
+			if !readable {
+				return result, nil
+			}
+			result.StatusKnown = true
+			if signal := current.ExitStatus & 0x7f; signal != 0 {
+				result.ExitCode = 128 + signal
+			} else {
+				result.ExitCode = (current.ExitStatus >> 8) & 0xff
+			}
+			return result, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// Format the result as a message.
+func (r WaitResult) Message() string {
+	var b strings.Builder
+
+	status := "🏁 Exited"
+	exit := "unknown"
+	if r.StatusKnown {
+		status = "✅ Finished"
+		if r.ExitCode != 0 {
+			status = "❌ Failed"
+		}
+		exit = strconv.Itoa(r.ExitCode)
+	}
+	cmdline := r.Cmdline
+	if runes := []rune(cmdline); len(runes) > maxCmdlineLength {
+		cmdline = string(runes[:maxCmdlineLength]) + "…"
+	}
+	fmt.Fprintf(&b, "%s: %s\n", status, cmdline)
+	fmt.Fprintf(&b, "Host: %s\n", r.Host)
+	fmt.Fprintf(&b, "PID: %d\n", r.Pid)
+	fmt.Fprintf(&b, "Exit: %s\n", exit)
+	fmt.Fprintf(&b, "Time: %s", r.Elapsed.Round(time.Second))
+	return b.String()
+}
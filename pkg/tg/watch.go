@@ -0,0 +1,313 @@
+package tg
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Interval of checking the file besides notifications, which network file systems may not deliver.
+const followPollInterval = 2 * time.Second
+
+// Follows the lines appended to a file by path, like `tail -F`.
+//
+// The file is reopened from the start when it is replaced, e.g. by log rotation,
+// and reread from the start when it is truncated.
+type fileFollower struct {
+	path    string
+	file    *os.File
+	offset  int64
+	partial []byte
+}
+
+// Open the file if it exists and is not opened yet, or has been replaced.
+//
+// With `fromEnd`, reading starts at the end of a newly opened file.
+func (f *fileFollower) reopen(fromEnd bool) {
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return
+	}
+
+	if f.file != nil {
+		if current, err := f.file.Stat(); err == nil && os.SameFile(current, stat) {
+			return
+		}
+		slog.Info("File is replaced, reopening", "path", f.path)
+		f.file.Close()
+		f.file = nil
+		f.partial = nil
+		fromEnd = false
+	}
+
+	file, err := os.Open(f.path)
+	if err != nil {
+		slog.Warn("Cannot open file", "path", f.path, "error", err)
+		return
+	}
+	f.file = file
+	f.offset = 0
+	if fromEnd {
+		f.offset, _ = file.Seek(0, io.SeekEnd)
+	}
+}
+
+// Read the complete lines appended since the last read.
+func (f *fileFollower) read() []string {
+	if f.file == nil {
+		return nil
+	}
+
+	if stat, err := f.file.Stat(); err == nil && stat.Size() < f.offset {
+		slog.Info("File is truncated, reading from start", "path", f.path)
+		f.offset = 0
+		f.partial = nil
+	}
+	if _, err := f.file.Seek(f.offset, io.SeekStart); err != nil {
+		return nil
+	}
+
+	data, err := io.ReadAll(f.file)
+	if err != nil {
+		slog.Warn("Cannot read file", "path", f.path, "error", err)
+	}
+	f.offset += int64(len(data))
+
+	data = append(f.partial, data...)
+	end := bytes.LastIndexByte(data, '\n')
+	if end < 0 {
+		f.partial = data
+		return nil
+	}
+	f.partial = append([]byte{}, data[end+1:]...)
+
+	lines := strings.Split(string(data[:end]), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, "\r")
+	}
+	return lines
+}
+
+// Follow the file until the context is done, sending the lines appended to it.
+//
+// The file may not exist yet, but its directory must.
+func followFile(ctx context.Context, path string, lines chan<- string) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	defer watcher.Close()
+
+	// Watch the directory, so that the file can be found again once replaced
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		return fmt.Errorf("cannot watch %s: %w", filepath.Dir(path), err)
+	}
+
+	f := &fileFollower{path: path}
+	defer func() {
+		if f.file != nil {
+			f.file.Close()
+		}
+	}()
+	f.reopen(true)
+	if f.file == nil {
+		slog.Info("File does not exist yet, waiting", "path", path)
+	}
+
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case event, ok := <-watcher.Events:
+			if !ok {
+				return nil
+			}
+			if filepath.Clean(event.Name) != filepath.Clean(path) {
+				continue
+			}
+		case err, ok := <-watcher.Errors:
+			if !ok {
+				return nil
+			}
+			slog.Warn("File watcher failed", "error", err)
+			continue
+		case <-ticker.C:
+		}
+
+		// Drain the replaced file before switching to the new one
+		for _, line := range f.read() {
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		f.reopen(false)
+		for _, line := range f.read() {
+			select {
+			case lines <- line:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+// Options of `Watch`.
+type WatchOptions struct {
+	Pattern *regexp.Regexp
+	// Number of lines before and after a match to include.
+	Context int
+	// Matches within this duration after the first one are sent together.
+	Debounce time.Duration
+	// Stop after the first message is sent.
+	Once bool
+}
+
+// Lines around matches to be sent together.
+type watchAlert struct {
+	lines   []string
+	matches int
+	// Number of lines after the last match still to include.
+	after int
+	// Length of the lines escaped, and whether more lines are left out to fit a message.
+	size int
+	full bool
+}
+
+// Add a line to the alert, unless the lines already fill a message.
+func (a *watchAlert) add(line string) {
+	if a.full {
+		return
+	}
+	n := utf8.RuneCountInString(EscapeHtml(line)) + 1
+	if a.size+n > maxMessageLength {
+		a.full = true
+		return
+	}
+	a.lines = append(a.lines, line)
+	a.size += n
+}
+
+// Format the alert as a message, leaving out the lines at the end that do not fit.
+func (a *watchAlert) message(path string, pattern *regexp.Regexp) string {
+	host, _ := os.Hostname()
+	plural := ""
+	if a.matches > 1 {
+		plural = "es"
+	}
+	header := EscapeHtml(fmt.Sprintf("🔎 %d match%s of /%s/ in %s on %s", a.matches, plural, pattern, path, host))
+
+	// Room for the lines, besides the code block and a final `…`
+	budget := maxMessageLength - utf8.RuneCountInString(header+"\n"+CodeBlock("\n…", ParseModeHtml))
+	lines, full := a.lines, a.full
+	for i, line := range lines {
+		if budget -= utf8.RuneCountInString(EscapeHtml(line)) + 1; budget < 0 {
+			lines, full = lines[:i], true
+			break
+		}
+	}
+	if len(lines) == 0 {
+		return header
+	}
+	if full {
+		lines = append(lines[:len(lines):len(lines)], "…")
+	}
+	return header + "\n" + CodeBlock(strings.Join(lines, "\n"), ParseModeHtml)
+}
+
+// Watch a file, sending the lines matching the pattern with their context to the chat.
+//
+// Runs until the context is done, or the first message is sent with `Once`.
+func Watch(ctx context.Context, chat Chat, path string, opts WatchOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	lines := make(chan string, 64)
+	followErr := make(chan error, 1)
+	go func() { followErr <- followFile(ctx, path, lines) }()
+
+	slog.Info("Watching file", "path", path, "pattern", opts.Pattern)
+
+	send := func(alert *watchAlert) {
+		_, err := SendText(chat, alert.message(path, opts.Pattern), TextOptions{ParseMode: ParseModeHtml, Queue: true})
+		if err != nil && !errors.Is(err, ErrQueued) {
+			slog.Error("Cannot send match", "error", err)
+		}
+	}
+
+	// Lines not in an alert, and how many since the last line of the alert
+	var before []string
+	var skipped int
+	var alert *watchAlert
+	var flush <-chan time.Time
+
+	for {
+		select {
+		case err := <-followErr:
+			if !errors.Is(err, context.Canceled) {
+				return err
+			}
+			// Stopped by the caller, still send what has matched
+			if alert != nil {
+				send(alert)
+			}
+			return nil
+
+		case line := <-lines:
+			matched := opts.Pattern.MatchString(line)
+
+			switch {
+			case matched:
+				if alert == nil {
+					slog.Debug("Matched line", "line", line)
+					alert = &watchAlert{}
+					flush = time.After(opts.Debounce)
+				} else if skipped > len(before) {
+					// Mark the lines left out since the last match
+					alert.add("…")
+				}
+				for _, line := range before {
+					alert.add(line)
+				}
+				alert.add(line)
+				alert.matches++
+				alert.after = opts.Context
+				before, skipped = nil, 0
+			case alert != nil && alert.after > 0:
+				alert.add(line)
+				alert.after--
+			default:
+				skipped++
+				if opts.Context > 0 {
+					before = append(before, line)
+					if len(before) > opts.Context {
+						before = before[len(before)-opts.Context:]
+					}
+				}
+			}
+
+		case <-flush:
+			send(alert)
+			alert, flush = nil, nil
+
+			if opts.Once {
+				return nil
+			}
+		}
+	}
+}
@@ -1,79 +1,315 @@
 package util
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
+
+	"github.com/charmbracelet/lipgloss"
 )
 
 type FzfLine[V any] struct {
 	Key    string
 	Pretty []string
+	// Style of each pretty column, columns without one are left plain.
+	Styles []lipgloss.Style
 	Raw    V
 }
 
+// Options of an interactive selection.
+type FzfOptions struct {
+	// Allow selecting multiple lines with Tab.
+	Multi bool
+	// Lines shown above the choices.
+	Header []string
+	// Initial query.
+	Query string
+	// Command to preview the current line, `{1}` is replaced with its key.
+	// Not supported by the builtin picker.
+	Preview string
+	// Keys such as `ctrl-d` that accept the selection besides Enter.
+	// The pressed key is returned in `FzfResult.Key`.
+	Expect []string
+	// Align the pretty columns as a table.
+	// All choices are collected before they are shown.
+	Align bool
+	// Extra arguments passed to `fzf` verbatim. Ignored by the builtin picker.
+	Args []string
+}
+
+// The result of an interactive selection.
+type FzfResult[V any] struct {
+	// The key in `FzfOptions.Expect` used to accept, empty for Enter.
+	Key string
+	// The selected values, in order.
+	Selected []V
+}
+
+var fzfEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+var fzfUnescaper = strings.NewReplacer(`\\`, `\`, `\t`, "\t", `\n`, "\n", `\r`, "\r")
+
+// Escape a field so that it can be safely placed in a tab-delimited `fzf` line.
+func fzfEscape(field string) string {
+	return fzfEscaper.Replace(field)
+}
+
+// The gap between aligned columns.
+const fzfColumnGap = "  "
+
+// Render the pretty columns of a line with their styles.
+//
+// If widths are given, each column except the last is padded to its width.
+func (line FzfLine[V]) render(r *lipgloss.Renderer, widths []int) string {
+	var b strings.Builder
+	for i, pretty := range line.Pretty {
+		pretty = fzfEscape(pretty)
+
+		if i > 0 {
+			if widths != nil {
+				b.WriteString(fzfColumnGap)
+			} else {
+				b.WriteString(" ")
+			}
+		}
+
+		if i < len(line.Styles) {
+			b.WriteString(line.Styles[i].Renderer(r).Render(pretty))
+		} else {
+			b.WriteString(pretty)
+		}
+
+		if widths != nil && i < len(line.Pretty)-1 && i < len(widths) {
+			b.WriteString(strings.Repeat(" ", max(0, widths[i]-lipgloss.Width(pretty))))
+		}
+	}
+	return b.String()
+}
+
+// Format a line as tab-delimited fields, the key and the rendered pretty columns.
+func (line FzfLine[V]) format(r *lipgloss.Renderer, widths []int) string {
+	return fzfEscape(line.Key) + "\t" + line.render(r, widths)
+}
+
+// The width of each pretty column among the lines.
+func fzfColumnWidths[V any](lines []FzfLine[V]) []int {
+	var widths []int
+	for _, line := range lines {
+		for i, pretty := range line.Pretty {
+			if i >= len(widths) {
+				widths = append(widths, 0)
+			}
+			widths[i] = max(widths[i], lipgloss.Width(fzfEscape(pretty)))
+		}
+	}
+	return widths
+}
+
+// Build the `fzf` arguments for the options.
+func (opts FzfOptions) fzfArgs() []string {
+	arg := []string{"--delimiter", "\t", "--with-nth", "2..", "--ansi"}
+	if opts.Multi {
+		arg = append(arg, "--multi")
+	}
+	if len(opts.Header) > 0 {
+		arg = append(arg, "--header", strings.Join(opts.Header, "\n"))
+	}
+	if opts.Query != "" {
+		arg = append(arg, "--query", opts.Query)
+	}
+	if opts.Preview != "" {
+		arg = append(arg, "--preview", opts.Preview)
+	}
+	if len(opts.Expect) > 0 {
+		arg = append(arg, "--expect", strings.Join(opts.Expect, ","))
+	}
+	return append(arg, opts.Args...)
+}
+
+// The user aborted the selection, e.g. with Esc or Ctrl-C.
+var ErrFzfCancelled = errors.New("selection is cancelled")
+
+// The user accepted while no line matched the query.
+var ErrFzfNoMatch = errors.New("no line is matched")
+
+// The `fzf` executable, replaceable for stubbing.
+var fzfBin = "fzf"
+
+// Pick a single value from the choices with `fzf`, or the builtin picker.
 func FzfGetFromChan[K comparable, V any](
+	ctx context.Context,
 	choices <-chan K,
 	fn func(K) (FzfLine[V], error),
-	arg ...string,
+	opts FzfOptions,
 ) (V, error) {
-	arg = append([]string{"--with-nth", "2.."}, arg...)
+	var zero V
 
-	fzf := exec.Command("fzf", arg...)
+	opts.Multi = false
+	result, err := FzfSelectFromChan(ctx, choices, fn, opts)
+	if err != nil {
+		return zero, err
+	}
+	return result.Selected[0], nil
+}
+
+// Select values from the choices with `fzf`, or the builtin picker.
+//
+// Each choice is turned into a line by `fn`, choices failing to do so are skipped.
+// Once the selection is made or aborted, the remaining choices are drained, so
+// their producer should also watch `ctx` to stop early.
+//
+// Returns `ErrFzfCancelled` if the user aborts, and `ErrFzfNoMatch` if nothing is selected.
+func FzfSelectFromChan[K comparable, V any](
+	ctx context.Context,
+	choices <-chan K,
+	fn func(K) (FzfLine[V], error),
+	opts FzfOptions,
+) (FzfResult[V], error) {
+	// Never block the producer after returning
+	defer func() {
+		go func() {
+			for range choices {
+			}
+		}()
+	}()
+
+	if useBuiltinPicker() {
+		return builtinSelectFromChan(ctx, choices, fn, opts)
+	}
+
+	parent := ctx
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	fzf := exec.CommandContext(ctx, fzfBin, opts.fzfArgs()...)
+
+	var mu sync.Mutex
 	mapping := make(map[string]V)
-	out := make(chan V, 1)
-	var zero V
 
 	pipeIn, err := fzf.StdinPipe()
 	if err != nil {
 		slog.Error("Failed to create stdin pipe of fzf", "error", err)
-		return zero, err
+		return FzfResult[V]{}, err
 	}
 
 	pipeOut, err := fzf.StdoutPipe()
 	if err != nil {
 		slog.Error("Failed to create stdout pipe of fzf", "error", err)
-		return zero, err
+		return FzfResult[V]{}, err
 	}
 
 	// fzf's stderr to this process
 	fzf.Stderr = os.Stderr
 
+	// fzf draws on the terminal, while stdout is usually captured
+	renderer := lipgloss.NewRenderer(os.Stderr)
+
+	if err := fzf.Start(); err != nil {
+		slog.Error("Failed to start fzf", "error", err)
+		return FzfResult[V]{}, err
+	}
+
+	producerDone := make(chan struct{})
 	go func() {
+		defer close(producerDone)
 		defer pipeIn.Close()
-		for choice := range choices {
+
+		write := func(line FzfLine[V], widths []int) bool {
+			if _, err := fmt.Fprintln(pipeIn, line.format(renderer, widths)); err != nil {
+				// fzf has exited, the selection is made or aborted
+				slog.Debug("Stopped writing to fzf stdin", "error", err)
+				return false
+			}
+			return true
+		}
+
+		// Lines held back until all are known when aligning
+		var pending []FzfLine[V]
+
+	produce:
+		for {
+			var choice K
+			var ok bool
+			select {
+			case <-ctx.Done():
+				return
+			case choice, ok = <-choices:
+				if !ok {
+					break produce
+				}
+			}
 
 			line, err := fn(choice)
 			if err != nil {
 				continue
 			}
+
+			mu.Lock()
 			mapping[line.Key] = line.Raw
-			if _, err := fmt.Fprintf(pipeIn, "%s %s\n", line.Key, strings.Join(line.Pretty, " ")); err != nil {
-				slog.Error("Failed to write to fzf stdin", "error", err)
+			mu.Unlock()
+
+			if opts.Align {
+				pending = append(pending, line)
+			} else if !write(line, nil) {
 				return
 			}
 		}
 
+		widths := fzfColumnWidths(pending)
+		for _, line := range pending {
+			if !write(line, widths) {
+				return
+			}
+		}
 	}()
 
-	go func() {
-		output, err := io.ReadAll(pipeOut)
-		if err != nil {
-			slog.Error("Failed to run fzf", "error", err)
-			return
-		}
+	output, readErr := io.ReadAll(pipeOut)
+	waitErr := fzf.Wait()
 
-		outBytesFirst, _, _ := bytes.Cut(output, []byte(" "))
-		out <- mapping[string(outBytesFirst)]
-	}()
+	// Stop the producer and wait for it, so the mapping is complete and safe to read
+	cancel()
+	<-producerDone
 
-	if err := fzf.Run(); err != nil {
-		slog.Error("Failed to run fzf", "error", err)
-		return zero, err
+	if readErr != nil {
+		slog.Error("Failed to read fzf output", "error", readErr)
+		return FzfResult[V]{}, readErr
+	}
+
+	var exitErr *exec.ExitError
+	switch {
+	case waitErr == nil:
+	case parent.Err() != nil:
+		return FzfResult[V]{}, parent.Err()
+	case errors.As(waitErr, &exitErr) && exitErr.ExitCode() == 130:
+		return FzfResult[V]{}, ErrFzfCancelled
+	case errors.As(waitErr, &exitErr) && exitErr.ExitCode() == 1:
+		return FzfResult[V]{}, ErrFzfNoMatch
+	default:
+		slog.Error("Failed to run fzf", "error", waitErr)
+		return FzfResult[V]{}, waitErr
+	}
+
+	var result FzfResult[V]
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	if len(opts.Expect) > 0 && scanner.Scan() {
+		result.Key = scanner.Text()
+	}
+	for scanner.Scan() {
+		escapedKey, _, _ := strings.Cut(scanner.Text(), "\t")
+		if value, ok := mapping[fzfUnescaper.Replace(escapedKey)]; ok {
+			result.Selected = append(result.Selected, value)
+		}
+	}
+
+	if len(result.Selected) == 0 {
+		return FzfResult[V]{}, ErrFzfNoMatch
 	}
-	return <-out, nil
+	return result, nil
 }
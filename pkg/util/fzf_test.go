@@ -0,0 +1,252 @@
+package util
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// A stub of `fzf`, saving its input and printing the `--expect` key and the lines
+// picked by a `sed` script, then exiting with the code given.
+const fzfStub = `#!/bin/sh
+cat > "$FZF_STUB_INPUT"
+[ -n "$FZF_STUB_KEY" ] && echo "$FZF_STUB_KEY"
+[ -n "$FZF_STUB_SED" ] && sed -n "$FZF_STUB_SED" "$FZF_STUB_INPUT"
+exit "${FZF_STUB_EXIT:-0}"
+`
+
+// Replace `fzf` with a stub script for the test, returning the path of its saved input.
+func stubFzf(t *testing.T, script string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "fzf")
+	if err := os.WriteFile(bin, []byte(script), 0o755); err != nil {
+		t.Fatal(err)
+	}
+
+	oldBin, oldPicker := fzfBin, Picker
+	fzfBin, Picker = bin, "fzf"
+	t.Cleanup(func() { fzfBin, Picker = oldBin, oldPicker })
+
+	input := filepath.Join(dir, "input")
+	t.Setenv("FZF_STUB_INPUT", input)
+	return input
+}
+
+func sendAll[K any](choices ...K) <-chan K {
+	ch := make(chan K)
+	go func() {
+		defer close(ch)
+		for _, choice := range choices {
+			ch <- choice
+		}
+	}()
+	return ch
+}
+
+func plainLine(key string) (FzfLine[string], error) {
+	return FzfLine[string]{Key: key, Pretty: []string{"pretty " + key}, Raw: key}, nil
+}
+
+func TestFzfCancelled(t *testing.T) {
+	stubFzf(t, fzfStub)
+	t.Setenv("FZF_STUB_EXIT", "130")
+
+	_, err := FzfSelectFromChan(context.Background(), sendAll("a", "b"), plainLine, FzfOptions{})
+	if !errors.Is(err, ErrFzfCancelled) {
+		t.Fatalf("got %v, want ErrFzfCancelled", err)
+	}
+}
+
+func TestFzfNoMatch(t *testing.T) {
+	stubFzf(t, fzfStub)
+	t.Setenv("FZF_STUB_EXIT", "1")
+
+	_, err := FzfSelectFromChan(context.Background(), sendAll("a", "b"), plainLine, FzfOptions{})
+	if !errors.Is(err, ErrFzfNoMatch) {
+		t.Fatalf("got %v, want ErrFzfNoMatch", err)
+	}
+}
+
+func TestFzfMulti(t *testing.T) {
+	stubFzf(t, fzfStub)
+	t.Setenv("FZF_STUB_SED", "1p;3p")
+
+	result, err := FzfSelectFromChan(context.Background(), sendAll("a", "b", "c"), plainLine, FzfOptions{Multi: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a", "c"}; !slices.Equal(result.Selected, want) {
+		t.Fatalf("got %v, want %v", result.Selected, want)
+	}
+	if result.Key != "" {
+		t.Fatalf("got key %q without --expect", result.Key)
+	}
+}
+
+func TestFzfExpect(t *testing.T) {
+	stubFzf(t, fzfStub)
+	t.Setenv("FZF_STUB_KEY", "ctrl-d")
+	t.Setenv("FZF_STUB_SED", "2p")
+
+	result, err := FzfSelectFromChan(context.Background(), sendAll("a", "b"), plainLine, FzfOptions{Expect: []string{"ctrl-d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Key != "ctrl-d" || !slices.Equal(result.Selected, []string{"b"}) {
+		t.Fatalf("got %+v, want ctrl-d and [b]", result)
+	}
+}
+
+func TestFzfExpectEnter(t *testing.T) {
+	stubFzf(t, fzfStub)
+	// fzf prints an empty key line when accepted with Enter
+	t.Setenv("FZF_STUB_SED", "1{x;p;x;p}")
+
+	result, err := FzfSelectFromChan(context.Background(), sendAll("a", "b"), plainLine, FzfOptions{Expect: []string{"ctrl-d"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Key != "" || !slices.Equal(result.Selected, []string{"a"}) {
+		t.Fatalf("got %+v, want no key and [a]", result)
+	}
+}
+
+func TestFzfEscaping(t *testing.T) {
+	input := stubFzf(t, fzfStub)
+	t.Setenv("FZF_STUB_SED", "2p")
+
+	keys := []string{"plain", "tab\there", `back\slash`, "new\nline"}
+	result, err := FzfSelectFromChan(context.Background(), sendAll(keys...), func(key string) (FzfLine[string], error) {
+		return FzfLine[string]{Key: key, Pretty: []string{key}, Raw: key}, nil
+	}, FzfOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Selected, []string{"tab\there"}) {
+		t.Fatalf("got %q, want the key with a tab", result.Selected)
+	}
+
+	content, err := os.ReadFile(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(content), "\n"), "\n")
+	want := []string{
+		"plain\tplain",
+		`tab\there` + "\t" + `tab\there`,
+		`back\\slash` + "\t" + `back\\slash`,
+		`new\nline` + "\t" + `new\nline`,
+	}
+	if !slices.Equal(lines, want) {
+		t.Fatalf("got input %q, want %q", lines, want)
+	}
+
+	// Each escaped key is picked back
+	for i, key := range keys {
+		t.Setenv("FZF_STUB_SED", strings.Repeat("n;", i)+"p;q")
+		result, err := FzfSelectFromChan(context.Background(), sendAll(keys...), func(key string) (FzfLine[string], error) {
+			return FzfLine[string]{Key: key, Pretty: []string{key}, Raw: key}, nil
+		}, FzfOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(result.Selected, []string{key}) {
+			t.Fatalf("got %q, want %q", result.Selected, key)
+		}
+	}
+}
+
+func TestFzfSkipsFailedLines(t *testing.T) {
+	stubFzf(t, fzfStub)
+	t.Setenv("FZF_STUB_SED", "1p")
+
+	result, err := FzfSelectFromChan(context.Background(), sendAll("bad", "good"), func(key string) (FzfLine[string], error) {
+		if key == "bad" {
+			return FzfLine[string]{}, errors.New("bad line")
+		}
+		return plainLine(key)
+	}, FzfOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(result.Selected, []string{"good"}) {
+		t.Fatalf("got %v, want [good]", result.Selected)
+	}
+}
+
+// fzf exiting without reading all choices must not block their producer.
+func TestFzfExitEarly(t *testing.T) {
+	stubFzf(t, "#!/bin/sh\nexit 130\n")
+
+	for _, align := range []bool{false, true} {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		choices := make(chan string)
+		produced := make(chan struct{})
+		go func() {
+			defer close(produced)
+			defer close(choices)
+			for {
+				select {
+				case choices <- "choice":
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+
+		done := make(chan error, 1)
+		go func() {
+			_, err := FzfSelectFromChan(ctx, choices, plainLine, FzfOptions{Align: align})
+			done <- err
+		}()
+
+		select {
+		case err := <-done:
+			if !errors.Is(err, ErrFzfCancelled) {
+				t.Fatalf("align %v: got %v, want ErrFzfCancelled", align, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("align %v: selection does not return after fzf exits", align)
+		}
+
+		cancel()
+		select {
+		case <-produced:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("align %v: producer is blocked after selection returns", align)
+		}
+	}
+}
+
+// The producer keeps being drained after returning, even if it ignores the context.
+func TestFzfDrainsProducer(t *testing.T) {
+	stubFzf(t, "#!/bin/sh\nexit 130\n")
+
+	choices := make(chan string)
+	produced := make(chan struct{})
+	go func() {
+		defer close(produced)
+		defer close(choices)
+		for i := 0; i < 1000; i++ {
+			choices <- "choice"
+		}
+	}()
+
+	if _, err := FzfSelectFromChan(context.Background(), choices, plainLine, FzfOptions{}); !errors.Is(err, ErrFzfCancelled) {
+		t.Fatalf("got %v, want ErrFzfCancelled", err)
+	}
+
+	select {
+	case <-produced:
+	case <-time.After(5 * time.Second):
+		t.Fatal("producer is blocked after selection returns")
+	}
+}
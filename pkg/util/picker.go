@@ -0,0 +1,468 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/muesli/reflow/truncate"
+	"golang.org/x/term"
+)
+
+// Which picker to use for interactive selection: `auto`, `fzf` or `builtin`.
+//
+// With `auto`, `fzf` is used when it is on PATH, otherwise the builtin picker.
+var Picker = "auto"
+
+// Parse the name of a picker, returning it normalized and whether it is valid.
+func ParsePicker(name string) (string, bool) {
+	switch name = strings.ToLower(name); name {
+	case "auto", "fzf", "builtin":
+		return name, true
+	}
+	return "", false
+}
+
+// Whether the builtin picker should be used instead of `fzf`.
+func useBuiltinPicker() bool {
+	switch Picker {
+	case "builtin":
+		return true
+	case "fzf":
+		return false
+	}
+
+	if _, err := exec.LookPath(fzfBin); err != nil {
+		slog.Info("fzf is not found on PATH, using builtin picker")
+		return true
+	}
+	return false
+}
+
+// Score how well the pattern fuzzily matches the text, higher is better.
+//
+// All characters of the pattern must appear in order in the text, ignoring case.
+// Consecutive characters and matches at word boundaries are preferred.
+func fuzzyScore(pattern string, text string) (int, bool) {
+	if pattern == "" {
+		return 0, true
+	}
+
+	pattern = strings.ToLower(pattern)
+	lower := strings.ToLower(text)
+
+	score := 0
+	last := -2
+	pos := 0
+	for _, r := range pattern {
+		if unicode.IsSpace(r) {
+			continue
+		}
+		i := strings.IndexRune(lower[pos:], r)
+		if i < 0 {
+			return 0, false
+		}
+		i += pos
+
+		score += 1
+		if i == last+1 {
+			score += 4
+		}
+		if i == 0 {
+			score += 3
+		} else {
+			prev, _ := utf8.DecodeLastRuneInString(lower[:i])
+			if !unicode.IsLetter(prev) && !unicode.IsDigit(prev) {
+				score += 2
+			}
+		}
+
+		last = i
+		pos = i + utf8.RuneLen(r)
+	}
+
+	// Shorter texts are better matches
+	return score*64 - len(text)/8, true
+}
+
+// Parse a `ctrl-<letter>` key name into the byte a terminal sends in raw mode.
+func parseCtrlKey(name string) (byte, bool) {
+	letter, ok := strings.CutPrefix(strings.ToLower(name), "ctrl-")
+	if !ok || len(letter) != 1 || letter[0] < 'a' || letter[0] > 'z' {
+		return 0, false
+	}
+	return letter[0] - 'a' + 1, true
+}
+
+type pickerItem[V any] struct {
+	line FzfLine[V]
+	// The plain text to search
+	text string
+}
+
+// A minimal interactive fuzzy picker drawn on the controlling terminal,
+// used when `fzf` is not available.
+type builtinPicker[V any] struct {
+	mu    sync.Mutex
+	items []pickerItem[V]
+	done  bool
+
+	query    []rune
+	cursor   int
+	offset   int
+	filtered []int
+	selected map[int]bool
+
+	opts   FzfOptions
+	expect map[byte]string
+
+	tty      *os.File
+	renderer *lipgloss.Renderer
+}
+
+// The builtin counterpart of `FzfSelectFromChan`.
+//
+// The pretty columns are shown and searched, the key identifies the line.
+// Only `ctrl-<letter>` keys can be expected, and preview is not supported.
+func builtinSelectFromChan[K comparable, V any](
+	ctx context.Context,
+	choices <-chan K,
+	fn func(K) (FzfLine[V], error),
+	opts FzfOptions,
+) (FzfResult[V], error) {
+	var zero FzfResult[V]
+
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		slog.Error("Failed to open terminal for picker", "error", err)
+		return zero, err
+	}
+	defer tty.Close()
+
+	p := &builtinPicker[V]{
+		tty:      tty,
+		renderer: lipgloss.NewRenderer(tty),
+		query:    []rune(opts.Query),
+		selected: make(map[int]bool),
+		opts:     opts,
+		expect:   make(map[byte]string),
+	}
+
+	for _, name := range opts.Expect {
+		if key, ok := parseCtrlKey(name); ok {
+			p.expect[key] = name
+		} else {
+			slog.Warn("Key is not supported by builtin picker", "key", name)
+		}
+	}
+	if opts.Preview != "" {
+		slog.Debug("Preview is not supported by builtin picker")
+	}
+
+	state, err := term.MakeRaw(int(tty.Fd()))
+	if err != nil {
+		slog.Error("Failed to set terminal to raw mode", "error", err)
+		return zero, err
+	}
+	defer term.Restore(int(tty.Fd()), state)
+
+	// Use the alternate screen and hide the cursor, restore on return
+	fmt.Fprint(tty, "\x1b[?1049h\x1b[?25l")
+	defer fmt.Fprint(tty, "\x1b[?25h\x1b[?1049l")
+
+	redraw := make(chan struct{}, 1)
+	notify := func() {
+		select {
+		case redraw <- struct{}{}:
+		default:
+		}
+	}
+
+	quit := make(chan struct{})
+	defer close(quit)
+
+	go func() {
+		defer func() {
+			p.mu.Lock()
+			p.done = true
+			p.mu.Unlock()
+			notify()
+		}()
+		for {
+			var choice K
+			var ok bool
+			select {
+			case <-quit:
+				return
+			case choice, ok = <-choices:
+				if !ok {
+					return
+				}
+			}
+
+			line, err := fn(choice)
+			if err != nil {
+				continue
+			}
+			p.mu.Lock()
+			p.items = append(p.items, pickerItem[V]{line: line, text: fzfEscape(strings.Join(line.Pretty, " "))})
+			p.mu.Unlock()
+			notify()
+		}
+	}()
+
+	winch := make(chan os.Signal, 1)
+	signal.Notify(winch, syscall.SIGWINCH)
+	defer signal.Stop(winch)
+
+	keys := make(chan []byte)
+	go func() {
+		defer close(keys)
+		for {
+			buf := make([]byte, 64)
+			n, err := tty.Read(buf)
+			if err != nil {
+				return
+			}
+			select {
+			case keys <- buf[:n]:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	p.render()
+	for {
+		select {
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		case <-redraw:
+		case <-winch:
+		case key, ok := <-keys:
+			if !ok {
+				return zero, ErrFzfCancelled
+			}
+			if result, done, err := p.handleKey(key); done {
+				return result, err
+			}
+		}
+		p.render()
+	}
+}
+
+// Handle one chunk of input. Returns the result, whether the picker should quit,
+// and why nothing is selected.
+func (p *builtinPicker[V]) handleKey(key []byte) (FzfResult[V], bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for len(key) > 0 {
+		if name, ok := p.expect[key[0]]; ok {
+			return p.accept(name)
+		}
+
+		switch {
+		case key[0] == '\r' || key[0] == '\n':
+			return p.accept("")
+		case key[0] == 3 || key[0] == 7 || (key[0] == 27 && len(key) == 1):
+			// Ctrl-C, Ctrl-G, Esc
+			return FzfResult[V]{}, true, ErrFzfCancelled
+		case key[0] == 27 && (key[1] == '[' || key[1] == 'O'):
+			// A CSI or SS3 sequence, taken whole up to its final byte
+			n := 2
+			if key[1] == '[' {
+				for n < len(key) && (key[n] < 0x40 || key[n] > 0x7e) {
+					n++
+				}
+			}
+			if n < len(key) {
+				switch key[n] {
+				case 'A':
+					p.cursor--
+				case 'B':
+					p.cursor++
+				}
+				n++
+			}
+			key = key[n:]
+			continue
+		case key[0] == 27:
+			// Ignore Alt with a key
+			_, size := utf8.DecodeRune(key[1:])
+			key = key[1+size:]
+			continue
+		case key[0] == '\t':
+			p.filter()
+			if p.opts.Multi && len(p.filtered) > 0 {
+				i := p.filtered[p.cursor]
+				if p.selected[i] {
+					delete(p.selected, i)
+				} else {
+					p.selected[i] = true
+				}
+				p.cursor++
+			}
+		case key[0] == 16 || key[0] == 11:
+			// Ctrl-P, Ctrl-K
+			p.cursor--
+		case key[0] == 14:
+			// Ctrl-N
+			p.cursor++
+		case key[0] == 127 || key[0] == 8:
+			if len(p.query) > 0 {
+				p.query = p.query[:len(p.query)-1]
+				p.cursor = 0
+			}
+		case key[0] == 21:
+			// Ctrl-U
+			p.query = p.query[:0]
+			p.cursor = 0
+		case key[0] < 32:
+			// Ignore other control keys
+		default:
+			r, size := utf8.DecodeRune(key)
+			if r != utf8.RuneError {
+				p.query = append(p.query, r)
+				p.cursor = 0
+			}
+			key = key[size:]
+			continue
+		}
+		key = key[1:]
+	}
+
+	return FzfResult[V]{}, false, nil
+}
+
+// Accept the selection with the given key. Must hold the lock.
+//
+// The marked lines are selected, or the current line if none is marked.
+func (p *builtinPicker[V]) accept(key string) (FzfResult[V], bool, error) {
+	p.filter()
+
+	result := FzfResult[V]{Key: key}
+	for i, item := range p.items {
+		if p.selected[i] {
+			result.Selected = append(result.Selected, item.line.Raw)
+		}
+	}
+	if len(result.Selected) == 0 && len(p.filtered) > 0 {
+		result.Selected = append(result.Selected, p.items[p.filtered[p.cursor]].line.Raw)
+	}
+
+	if len(result.Selected) == 0 {
+		return FzfResult[V]{}, true, ErrFzfNoMatch
+	}
+	return result, true, nil
+}
+
+// Filter and rank the items by the query. Must hold the lock.
+func (p *builtinPicker[V]) filter() {
+	query := string(p.query)
+	scores := make(map[int]int)
+	p.filtered = p.filtered[:0]
+	for i, item := range p.items {
+		if score, ok := fuzzyScore(query, item.text); ok {
+			p.filtered = append(p.filtered, i)
+			scores[i] = score
+		}
+	}
+	if query != "" {
+		sort.SliceStable(p.filtered, func(a, b int) bool {
+			return scores[p.filtered[a]] > scores[p.filtered[b]]
+		})
+	}
+
+	p.cursor = max(0, min(p.cursor, len(p.filtered)-1))
+}
+
+func (p *builtinPicker[V]) render() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.filter()
+
+	width, height, err := term.GetSize(int(p.tty.Fd()))
+	if err != nil || width <= 0 || height <= 0 {
+		width, height = 80, 24
+	}
+	rows := max(1, height-2-len(p.opts.Header))
+
+	if p.cursor < p.offset {
+		p.offset = p.cursor
+	} else if p.cursor >= p.offset+rows {
+		p.offset = p.cursor - rows + 1
+	}
+
+	promptStyle := p.renderer.NewStyle().Foreground(lipgloss.Color("4")).Bold(true)
+	infoStyle := p.renderer.NewStyle().Foreground(lipgloss.Color("8"))
+	cursorStyle := p.renderer.NewStyle().Foreground(lipgloss.Color("1")).Bold(true)
+
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J")
+	fmt.Fprintf(&b, "%s %s\r\n", promptStyle.Render(">"), string(p.query))
+
+	info := fmt.Sprintf("%d/%d", len(p.filtered), len(p.items))
+	if !p.done {
+		info += " ..."
+	}
+	if len(p.selected) > 0 {
+		info += fmt.Sprintf(" (%d)", len(p.selected))
+	}
+	b.WriteString(infoStyle.Render(info))
+	b.WriteString("\r\n")
+
+	for _, header := range p.opts.Header {
+		b.WriteString(infoStyle.Render(truncateRunes(header, width)))
+		b.WriteString("\r\n")
+	}
+
+	// Align over all items, so the columns stay put while filtering
+	var widths []int
+	if p.opts.Align {
+		lines := make([]FzfLine[V], len(p.items))
+		for i, item := range p.items {
+			lines[i] = item.line
+		}
+		widths = fzfColumnWidths(lines)
+	}
+
+	for row := 0; row < rows && p.offset+row < len(p.filtered); row++ {
+		i := p.offset + row
+		text := truncate.String(p.items[p.filtered[i]].line.render(p.renderer, widths), uint(max(0, width-2)))
+		mark := " "
+		if p.selected[p.filtered[i]] {
+			mark = cursorStyle.Render("*")
+		}
+		if i == p.cursor {
+			fmt.Fprintf(&b, "%s%s%s", cursorStyle.Render(">"), mark, text)
+		} else {
+			fmt.Fprintf(&b, " %s%s", mark, text)
+		}
+		b.WriteString("\r\n")
+	}
+
+	fmt.Fprint(p.tty, b.String())
+}
+
+// Truncate a string to at most n runes.
+func truncateRunes(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return string([]rune(s)[:n])
+}
@@ -0,0 +1,39 @@
+package util
+
+import "testing"
+
+func TestPickerHandleKeyEscapeSequences(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		input  string
+		query  string
+		cursor int
+	}{
+		{"typing", "ab", "ab", 0},
+		{"down", "\x1b[B", "", 1},
+		{"down in application mode", "\x1bOB", "", 1},
+		{"down with modifier", "\x1b[1;5B", "", 1},
+		{"delete", "a\x1b[3~b", "ab", 0},
+		{"page up and down", "\x1b[5~\x1b[6~a", "a", 0},
+		{"home and end", "\x1b[1~\x1b[4~\x1b[H\x1b[F", "", 0},
+		{"alt with a key", "a\x1bbc\x1bé", "ac", 0},
+		{"function key", "\x1bOPa", "a", 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := &builtinPicker[string]{selected: make(map[int]bool)}
+			if _, done, _ := p.handleKey([]byte(tt.input)); done {
+				t.Fatal("picker quit")
+			}
+			if string(p.query) != tt.query || p.cursor != tt.cursor {
+				t.Errorf("query, cursor = %q, %d, want %q, %d", string(p.query), p.cursor, tt.query, tt.cursor)
+			}
+		})
+	}
+}
+
+func TestPickerHandleKeyEscapeCancels(t *testing.T) {
+	p := &builtinPicker[string]{selected: make(map[int]bool)}
+	if _, done, err := p.handleKey([]byte("\x1b")); !done || err != ErrFzfCancelled {
+		t.Errorf("handleKey(Esc) = %v, %v, want cancelled", done, err)
+	}
+}